@@ -1,9 +1,13 @@
 package line
 
+import "unicode"
+
 type RefreshBehavior int
 type SignalHandler int
 type AllowPanics int
 type BracketedPaste int
+type DefaultKeybindings int
+type CtrlCBehavior int
 
 const (
 	RefreshBehaviorLazy RefreshBehavior = iota
@@ -25,11 +29,109 @@ const (
 	BracketedPasteDisabled
 )
 
+const (
+	DefaultKeybindingsEnabled DefaultKeybindings = iota
+	// DefaultKeybindingsDisabled leaves every key to the caller, Enter included, see Action for the
+	// functions the defaults are bound to.
+	DefaultKeybindingsDisabled
+)
+
+const (
+	// CtrlCBehaviorInterrupt interrupts the line on ^C, echoing ^C like the terminal would.
+	CtrlCBehaviorInterrupt CtrlCBehavior = iota
+	// CtrlCBehaviorSilentInterrupt interrupts the line on ^C without echoing anything.
+	CtrlCBehaviorSilentInterrupt
+	// CtrlCBehaviorKey makes ^C a plain key, see SetCtrlCIsInterrupt.
+	CtrlCBehaviorKey
+)
+
+// RawModeFlags are the terminal modes turned off while editing.
+type RawModeFlags uint32
+
+const (
+	// RawModeEcho stops the terminal from echoing input, the editor draws it instead.
+	RawModeEcho RawModeFlags = 1 << iota
+	// RawModeCanonical gets input to the editor as it's typed, instead of a line at a time.
+	RawModeCanonical
+	// RawModeSignals makes ^C, ^\ and ^Z plain keys instead of having the terminal send signals for them.
+	RawModeSignals
+	// RawModeFlowControl makes ^S and ^Q plain keys instead of having the terminal pause and resume output on them.
+	RawModeFlowControl
+	// RawModeCRToNL keeps the terminal from turning the carriage returns Enter sends into newlines,
+	// the editor takes a carriage return for Enter by itself.
+	RawModeCRToNL
+	// RawModeOutputProcessing stops the terminal from processing output, newlines then only move the cursor down.
+	// Prompts and buffers with newlines in them won't be drawn right with this.
+	RawModeOutputProcessing
+
+	// RawModeDefault is what the editor turns off unless told otherwise, just enough to handle input as it's typed.
+	RawModeDefault = RawModeEcho | RawModeCanonical
+)
+
+// Config sets up an editor in one go, instead of a string of setters after NewEditor.
+// The zero value of every field is the editor's default, so a zero Config is the same as NewEditor,
+// and only the options that differ need to be spelled out. Each field does what the setter named
+// after it does; options without a field (handlers, styles, the prompt) are still set on the editor.
 type Config struct {
+	// RefreshBehavior defaults to redrawing only what changed, see SetAlwaysRefresh.
 	RefreshBehavior RefreshBehavior
-	SignalHandler   SignalHandler
-	AllowPanics     AllowPanics
-	BracketedPaste  BracketedPaste
+	// SignalHandler defaults to handling SIGWINCH and SIGINT.
+	SignalHandler SignalHandler
+	// AllowPanics defaults to letting a panic while editing (e.g. in a handler) out of GetLine once the terminal is
+	// restored; PanicsDisabled has GetLine return it as an ErrPanicked error instead.
+	AllowPanics AllowPanics
+	// BracketedPaste defaults to enabled.
+	BracketedPaste BracketedPaste
+	// DefaultKeybindings defaults to the emacs-like bindings the editor comes with.
+	DefaultKeybindings DefaultKeybindings
+	// RawModeFlags defaults to RawModeDefault.
+	RawModeFlags RawModeFlags
+	// CtrlC defaults to interrupting the line and echoing ^C.
+	CtrlC CtrlCBehavior
+	// KeepEditingAfterInterrupt defaults to false, interrupts end GetLine.
+	KeepEditingAfterInterrupt bool
+	// ReturnLineOnInterrupt defaults to false, interrupted lines are dropped.
+	ReturnLineOnInterrupt bool
+	// TrimTrailingWhitespaceOnSubmit defaults to false.
+	TrimTrailingWhitespaceOnSubmit bool
+	// Normalization defaults to NormNone, lines are returned as typed.
+	Normalization Normalization
+	// FocusReporting defaults to disabled.
+	FocusReporting bool
+	// PasteDetectionThreshold defaults to 0, no paste detection.
+	PasteDetectionThreshold int
+	// MaxPasteSize defaults to 0, no limit.
+	MaxPasteSize int
+
+	// BellStyle defaults to ringing the terminal's bell.
+	BellStyle BellStyle
+
+	// HistoryCapacity defaults to 0, keeping every entry.
+	HistoryCapacity uint32
+	// HistoryBoundary defaults to ringing the bell past the oldest entry.
+	HistoryBoundary HistoryBoundary
+	// HistorySearchScope defaults to searching all of the history.
+	HistorySearchScope HistorySearchScope
+
+	// MultilineMode defaults to false, Enter submits the line.
+	MultilineMode bool
+	// LineWrapMode defaults to wrapping long lines.
+	LineWrapMode LineWrapMode
+	// WrapIndent defaults to 0.
+	WrapIndent uint32
+
+	// BeepOnAmbiguousCompletion defaults to false.
+	BeepOnAmbiguousCompletion bool
+	// ConfirmSingleCompletion defaults to false, a lone completion is committed right away,
+	// see SetAutoCommitSingleCompletion.
+	ConfirmSingleCompletion bool
+	// OmitCompletionSpace defaults to false, a space is added after committed completions,
+	// see SetCompletionAppendSpace.
+	OmitCompletionSpace bool
+	// MinCompletionPrefix defaults to 0, tab always asks for completions.
+	MinCompletionPrefix uint32
+	// MaxSuggestionLines defaults to 0, as many lines as fit on the screen.
+	MaxSuggestionLines uint32
 }
 
 func NewEditorWithConfig(config *Config) Editor {
@@ -58,9 +160,43 @@ func NewEditorWithConfig(config *Config) Editor {
 		alwaysRefresh:                          disableLazyRefresh,
 		allowPanics:                            allowPanics,
 		enableBracketedPaste:                   enableBracketedPaste,
+		ctrlCIsInterrupt:                       true,
+		echoCtrlCOnInterrupt:                   true,
+		rawModeFlags:                           RawModeDefault,
+		selectionStyle:                         Style{BackgroundColor: MakeXtermColor(XtermColorBlue)},
 	}
 	editor.getTerminalSize()
 	editor.suggestionDisplay.setVTSize(editor.numLines, editor.numColumns)
+
+	// The defaults are only registered on the first Initialize, pretending that happened keeps them out.
+	editor.defaultKeybindsRegistered = config.DefaultKeybindings == DefaultKeybindingsDisabled
+	if config.RawModeFlags != 0 {
+		editor.SetRawModeFlags(config.RawModeFlags)
+	}
+	editor.SetCtrlCIsInterrupt(config.CtrlC != CtrlCBehaviorKey)
+	editor.SetEchoCtrlCOnInterrupt(config.CtrlC == CtrlCBehaviorInterrupt)
+	editor.SetKeepEditingAfterInterrupt(config.KeepEditingAfterInterrupt)
+	editor.SetReturnLineOnInterrupt(config.ReturnLineOnInterrupt)
+	editor.SetTrimTrailingWhitespaceOnSubmit(config.TrimTrailingWhitespaceOnSubmit)
+	editor.SetNormalization(config.Normalization)
+	editor.SetFocusReportingEnabled(config.FocusReporting)
+	editor.SetPasteDetectionThreshold(config.PasteDetectionThreshold)
+	editor.SetMaxPasteSize(config.MaxPasteSize)
+	editor.SetBellStyle(config.BellStyle)
+
+	editor.SetHistoryCapacity(config.HistoryCapacity)
+	editor.SetHistoryBoundary(config.HistoryBoundary)
+	editor.SetHistorySearchScope(config.HistorySearchScope)
+
+	editor.SetMultilineMode(config.MultilineMode)
+	editor.SetLineWrapMode(config.LineWrapMode)
+	editor.SetWrapIndent(config.WrapIndent)
+
+	editor.SetBeepOnAmbiguousCompletion(config.BeepOnAmbiguousCompletion)
+	editor.SetAutoCommitSingleCompletion(!config.ConfirmSingleCompletion)
+	editor.SetCompletionAppendSpace(!config.OmitCompletionSpace)
+	editor.SetMinCompletionPrefix(config.MinCompletionPrefix)
+	editor.SetMaxSuggestionLines(config.MaxSuggestionLines)
 	return editor
 }
 
@@ -76,6 +212,18 @@ func MakeXtermColor(color XtermColor) Color {
 	}
 }
 
+// CompletionContext is what a ContextTabCompletionHandler gets to complete.
+// Cursor, TokenStart and TokenEnd are offsets in code points into Line,
+// Token is the token around the cursor (as TokenAtCursor has it), and Prefix is the part of it before the cursor, as typed.
+type CompletionContext struct {
+	Line       string
+	Cursor     uint32
+	Token      string
+	Prefix     string
+	TokenStart uint32
+	TokenEnd   uint32
+}
+
 type Completion struct {
 	Text                      string
 	TrailingTrivia            string
@@ -86,6 +234,9 @@ type Completion struct {
 	StaticOffset              uint32
 	InvariantOffset           uint32
 	AllowCommitWithoutListing bool
+	// DisplayWidth, if set, is how many columns Text and DisplayTrivia take together when listed,
+	// e.g. for trivia with escape sequences in it; otherwise it's measured from them.
+	DisplayWidth uint32
 
 	textView           []rune
 	trailingTriviaView []rune
@@ -98,17 +249,78 @@ const (
 	ModifierCtrl  = 4
 )
 
-type key struct {
+// KeyPress is a single key press, as the terminal sends it: key is the code point of what was typed, where Ctrl with
+// a letter (or one of @[\]^_?) is the control character for it and Shift with a letter its uppercase form;
+// modifiers has ModifierAlt set for Alt (or Escape before it). Those are the only ways keys can differ,
+// and bindings only ever see keys like that, build them with Key, Ctrl, Alt, CtrlAlt or KeyWithModifiers.
+type KeyPress struct {
 	modifiers int
 	key       uint32
 }
 
-type KeybindingCallback func([]key, Editor) bool
+// Code returns the code point k types.
+func (k KeyPress) Code() rune {
+	return rune(k.key)
+}
+
+// Modifiers returns the Modifier* bits k is pressed with, only ModifierAlt ever is.
+func (k KeyPress) Modifiers() int {
+	return k.modifiers
+}
+
+// KeyWithModifiers is c pressed with modifiers (any of ModifierShift, ModifierAlt and ModifierCtrl),
+// turned into the key terminals send for it.
+func KeyWithModifiers(c rune, modifiers int) KeyPress {
+	k := KeyPress{key: uint32(c), modifiers: modifiers & ModifierAlt}
+	if modifiers&ModifierShift != 0 {
+		k.key = uint32(unicode.ToUpper(c))
+	}
+	if modifiers&ModifierCtrl != 0 {
+		k.key = controlCharacter(c)
+	}
+	return k
+}
+
+// Key is the key that types c, e.g. Key('x') or Key('\t').
+func Key(c rune) KeyPress {
+	return KeyPress{key: uint32(c)}
+}
+
+// Ctrl is c pressed with Ctrl, e.g. Ctrl('R') or Ctrl('r'); that's the control character terminals send for it.
+func Ctrl(c rune) KeyPress {
+	return KeyPress{key: controlCharacter(c)}
+}
+
+// Alt is c pressed with Alt (or Meta, or after Escape), e.g. Alt('b').
+func Alt(c rune) KeyPress {
+	return KeyPress{key: uint32(c), modifiers: ModifierAlt}
+}
+
+// CtrlAlt is c pressed with both Ctrl and Alt, e.g. CtrlAlt('L').
+func CtrlAlt(c rune) KeyPress {
+	return KeyPress{key: controlCharacter(c), modifiers: ModifierAlt}
+}
+
+// Chord is the keys pressed one after the other, e.g. Chord(Ctrl('X'), Ctrl('E')), for RegisterKeybinding and friends.
+func Chord(keys ...KeyPress) []KeyPress {
+	return keys
+}
+
+// KeybindingCallback is called with the keys it's bound to when they're pressed, and returns whether
+// the editor should go on to handle the last of them as it would have otherwise.
+type KeybindingCallback func([]KeyPress, Editor) bool
 type TabCompletionHandler func(editor Editor) []Completion
+type ContextTabCompletionHandler func(context CompletionContext, editor Editor) []Completion
 type PasteHandler func(pastedData string, editor Editor)
+type RawSequenceCallback func(sequence []byte, editor Editor)
+type ControlCharRenderer func(r rune) (display string, width uint32)
+
+// InputLogger is called with every batch of bytes read from the terminal (decoded as "read"),
+// and then with the bytes and a description of every key or sequence decoded from them.
+type InputLogger func(raw []byte, decoded string)
 
 type KeyBinding struct {
-	keys    []key
+	keys    []KeyPress
 	binding KeybindingCallback
 }
 
@@ -142,6 +354,63 @@ type Span struct {
 	Mode  SpanMode
 }
 
+// HistorySearchScope decides which history entries searching the history (and going through it) covers.
+type HistorySearchScope int
+
+const (
+	// HistorySearchScopeAll covers all of the history, including what was loaded from a file.
+	HistorySearchScopeAll HistorySearchScope = iota
+	// HistorySearchScopeSession only covers the entries added after the last LoadHistory.
+	HistorySearchScopeSession
+)
+
+// HistoryBoundary decides what going through the history does past either end of it.
+type HistoryBoundary int
+
+const (
+	// HistoryBoundaryBeep rings the bell on going past the oldest entry.
+	HistoryBoundaryBeep HistoryBoundary = iota
+	// HistoryBoundarySilent does nothing on going past the oldest entry.
+	HistoryBoundarySilent
+	// HistoryBoundaryWrap goes from the oldest entry back to the line being edited, and from that to the oldest entry.
+	HistoryBoundaryWrap
+)
+
+// BellStyle decides what ringing the bell (on going past the end of the history, having nothing to complete...) does.
+type BellStyle int
+
+const (
+	// BellStyleAudible rings the terminal's bell.
+	BellStyleAudible BellStyle = iota
+	// BellStyleVisible flashes the screen instead.
+	BellStyleVisible
+	// BellStyleNone does nothing.
+	BellStyleNone
+)
+
+// LineWrapMode decides what happens to a buffer that doesn't fit in the terminal's width.
+type LineWrapMode int
+
+const (
+	// LineWrapModeWrap continues the buffer on the next rows.
+	LineWrapModeWrap LineWrapMode = iota
+	// LineWrapModeScroll keeps the buffer on the prompt's row, and scrolls it sideways to follow the cursor.
+	// Buffers with newlines in them are always wrapped.
+	LineWrapModeScroll
+)
+
+// Normalization is the Unicode normalization form GetLine returns lines in.
+type Normalization int
+
+const (
+	// NormNone returns the line as it was typed (or pasted), in whatever mix of forms that is.
+	NormNone Normalization = iota
+	// NormNFC returns the line in Normalization Form C, with accents composed into the letters they go on where possible.
+	NormNFC
+	// NormNFD returns the line in Normalization Form D, with accents decomposed, as e.g. macOS stores file names.
+	NormNFD
+)
+
 type XtermColor int
 
 const (
@@ -227,36 +496,147 @@ type Editor interface {
 	AddToHistory(line string)
 	LoadHistory(path string) error
 	SaveHistory(path string) error
-
-	RegisterKeybinding(keys []key, binding KeybindingCallback)
+	SetHistorySearchScope(scope HistorySearchScope)
+	SetHistoryBoundary(boundary HistoryBoundary)
+	SetHistoryCapacity(capacity uint32)
+	SetBellStyle(style BellStyle)
+
+	RegisterKeybinding(keys []KeyPress, binding KeybindingCallback)
+	RegisterKeybindingString(spec string, binding KeybindingCallback) error
+	LoadKeybindings(path string) error
+	UnregisterKeybinding(keys []KeyPress)
+	DisableKeybinding(keys []KeyPress)
+	RestoreDefaultKeybinding(keys []KeyPress)
+	RegisterRawSequence(sequence []byte, callback RawSequenceCallback)
 	ActualRenderedStringMetrics(line string) StringMetrics
 
 	SetTabCompletionHandler(handler TabCompletionHandler)
+	SetContextTabCompletionHandler(handler ContextTabCompletionHandler)
+	// SetTokenizer sets how to split the line into tokens, for TokenAtCursor and completion. With one set,
+	// completions returned without an InvariantOffset or StaticOffset get them from the token being completed:
+	// what's typed of it is kept if the completion starts with what it stands for, and replaced by the completion
+	// otherwise. Completions go in quoted (or escaped) like what's typed, so they're read back as one token.
+	SetTokenizer(tokenizer Tokenizer)
+	SetBeepOnAmbiguousCompletion(beep bool)
+	// SetAutoCommitSingleCompletion sets whether a completion that's the only one is committed to (trivia and all)
+	// right away, which it is by default, or only put in the buffer until tab is pressed again.
+	SetAutoCommitSingleCompletion(autoCommit bool)
+	// SetCompletionAppendSpace sets whether completions are committed to along with their TrailingTrivia
+	// (usually a space), which they are by default. Leaving it out suits e.g. completing a path a directory at a time.
+	SetCompletionAppendSpace(appendTrivia bool)
+	// SetCompletionSort sets how to order the completions the handler returns before they're cycled through and listed,
+	// nil keeps them in the order they were returned in.
+	SetCompletionSort(less func(a, b Completion) bool)
+	SetCompletionQuickSelect(enabled bool)
+	SetMaxSuggestionLines(lines uint32)
+	SetMinCompletionPrefix(length uint32)
 	SetPasteHandler(handler PasteHandler)
+	SetPasteDetectionThreshold(threshold int)
+	SetMaxPasteSize(size int)
+	SetBracketedPasteEnabled(enabled bool)
+	SetFocusReportingEnabled(enabled bool)
+	// SetFocusHandler sets a handler to call when the terminal gains or loses focus, see SetFocusReportingEnabled.
+	SetFocusHandler(handler func(focused bool))
 	SetInterruptHandler(handler func())
+	TriggerInterrupt()
+	// SetRefreshHandler sets a handler to call before the buffer is drawn, whenever there's more to it than moving the cursor.
+	// Whatever the handler changes (SetLine, Stylize, SetPrompt...) is drawn by the same refresh, so don't expect
+	// calling Redraw or anything else that refreshes from in there to draw anything right away.
 	SetRefreshHandler(handler func(editor Editor))
+	// SetResizeHandler sets a handler to call with the new size when the terminal is resized,
+	// once the editor has redrawn everything for it.
+	SetResizeHandler(handler func(newSize Winsize))
+	// SetBufferChangedHandler sets a handler to call when the contents of the buffer changed,
+	// once per refresh and before drawing, no matter how many edits went into it. Cursor movement alone doesn't count.
+	SetBufferChangedHandler(handler func(editor Editor))
+	SetControlCharRenderer(renderer ControlCharRenderer)
+	SetInputLogger(logger InputLogger)
+
+	// SetAlwaysRefresh makes every refresh redraw the whole prompt and buffer, instead of only writing out what changed.
+	// This is what prompts that change on their own (e.g. a clock) need, but costs a full redraw per keypress,
+	// which is noticeable on slow links. It is the same as RefreshBehaviorEager in Config.
+	SetAlwaysRefresh(always bool)
+	AlwaysRefresh() bool
+
+	SetTrimTrailingWhitespaceOnSubmit(trim bool)
+	// SetNormalization sets the Unicode normalization form of the lines GetLine returns, NormNone (the default)
+	// leaves them alone. The buffer itself is never normalized, only what's returned.
+	SetNormalization(form Normalization)
+	SetReturnLineOnInterrupt(keep bool)
+	SetKeepEditingAfterInterrupt(keep bool)
+	SetCtrlCIsInterrupt(interrupt bool)
+	SetEchoCtrlCOnInterrupt(echo bool)
+	SetRawModeFlags(flags RawModeFlags)
 
 	SetLine(string)
+	ClearLine()
 	Line() string
+	IsDirty() bool
 	LineUpTo(n uint32) string
+	RenderStyled(includePrompt bool) string
+	TokenAtCursor() (token string, start, end uint32)
+	WordAtCursor() (word string, start, end uint32)
 
 	SetPrompt(prompt string)
+	PushPrompt(prompt string)
+	PopPrompt()
+	SetPromptEscapesEnabled(enabled bool)
+	SetHeader(lines []string)
+	SetMultilineMode(enabled bool)
+	SetLineWrapMode(mode LineWrapMode)
+	SetBleedStyleToEndOfLine(bleed bool)
+	// SetWrapIndent indents the rows a line that's too long for the terminal wraps onto by indent columns.
+	// The prompt is expected to fit on its row.
+	SetWrapIndent(indent uint32)
+	// SetPlaceholder shows text after the prompt while the buffer is empty, in style (grey if it's empty).
+	// It's never part of the line, and is cut short rather than wrapped.
+	SetPlaceholder(text string, style Style)
+	// SetHintHandler sets a handler whose result is shown dimmed on the row below the buffer on every refresh,
+	// e.g. the syntax of the command being typed; nothing is shown while it returns "".
+	SetHintHandler(handler func(line string, cursor uint32) string)
+	SetRevealMasks(reveal bool)
+	RevealMasks() bool
+	SetTitle(title string)
+	SetTitleCallback(callback func(editor Editor) string)
 
 	NumLines() uint32
+	// PromptEndPosition returns where the prompt ends and the buffer starts, as the row below the one the
+	// prompt starts on (0 being that row) and the column in it (0 being the first). It's only meaningful while editing.
+	PromptEndPosition() (row, col uint32)
 
 	InsertString(str string)
 	InsertChar(ch rune)
 
 	Stylize(span Span, style Style)
+	SetInputStyle(style Style)
 	StripStyles()
 
+	// Selection returns the range of code points between the selection's anchor and the cursor, if there's a selection.
+	// Shift with the arrow keys, Home or End starts or extends one, typing or erasing replaces it.
+	Selection() (start, end uint32, ok bool)
+	SetSelection(anchor, cursor uint32)
+	ClearSelection()
+	SetSelectionStyle(style Style)
+	DeleteSelection() bool
+	ReplaceSelection(text string) bool
+
+	CommitSuggestion(index uint32) bool
+	CommitPendingCompletion()
+	IsShowingCompletions() bool
 	TransformSuggestionOffsets(invariant uint32, static uint32, mode SpanMode) (uint32, uint32)
 
 	TerminalSize() Winsize
+	PositionOf(offset uint32) (row, col uint32)
+	CursorRow() uint32
+	CursorColumn() uint32
+
+	SuspendAndRun(fn func() error) error
+	Redraw()
 
 	Finish()
 	Reset()
 	IsEditing() bool
+	LastError() error
 }
 
 type searchOffsetState int
@@ -289,6 +669,7 @@ const (
 	inputStateCSIExpectParameter
 	inputStateCSIExpectIntermediate
 	inputStateCSIExpectFinal
+	inputStateSS3
 )
 
 type spans struct {
@@ -297,8 +678,10 @@ type spans struct {
 }
 
 type keyCallbackMachine interface {
-	registerInputCallback([]key, KeybindingCallback)
-	keyPressed(key, Editor)
+	registerInputCallback([]KeyPress, KeybindingCallback)
+	disableInputCallback([]KeyPress)
+	unregisterInputCallback([]KeyPress)
+	keyPressed(KeyPress, Editor)
 	interrupted(Editor)
 	shouldProcessLastPressedKey() bool
 }
@@ -312,6 +695,10 @@ type suggestionDisplay interface {
 	setVTSize(uint32, uint32)
 	setOrigin(uint32, uint32)
 	originRow() uint32
+	setMaxLines(uint32)
+	setQuickSelect(bool)
+	quickSelectIndex(rune) (uint32, bool)
+	isShowing() bool
 }
 
 type iterationDecision int
@@ -340,16 +727,22 @@ type completionAttemptResult struct {
 	styleToApply                      Style
 	hasStyleToApply                   bool
 	avoidCommittingToSingleSuggestion bool
+	ringBell                          bool
 }
 
 type suggestionManager interface {
 	setSuggestions([]Completion)
+	setBeepOnAmbiguousCompletion(bool)
+	setConfirmSingleSuggestion(bool)
+	setOmitTrailingTrivia(bool)
+	setSort(less func(a, b Completion) bool)
 	setCurrentSuggestionInitiationIndex(uint32)
 	count() uint32
 	displayLength() uint32
 	startIndex() uint32
 	nextIndex() uint32
 	setStartIndex(uint32)
+	setNextIndex(uint32)
 
 	forEachSuggestion(func(*Completion, uint32) iterationDecision) uint32
 
@@ -370,30 +763,70 @@ func (m *LineMetrics) TotalLength() uint32 {
 }
 
 func (m *StringMetrics) LinesWithAddition(offset *StringMetrics, columnWidth uint32) uint32 {
+	return m.linesWithAddition(offset, columnWidth, 0)
+}
+
+// linesWithAddition is LinesWithAddition with the rows offset's lines wrap onto indented by indent columns.
+func (m *StringMetrics) linesWithAddition(offset *StringMetrics, columnWidth, indent uint32) uint32 {
 	lines := uint32(0)
 	for _, line := range m.LineMetrics[:len(m.LineMetrics)-1] {
-		lines += (line.TotalLength() + columnWidth) / columnWidth
+		lines += wrappedRows(line.TotalLength(), columnWidth, 0)
 	}
 
 	last := m.LineMetrics[len(m.LineMetrics)-1].TotalLength()
 	last += offset.LineMetrics[0].TotalLength()
-	lines += (last + columnWidth) / columnWidth
+	lines += wrappedRows(last, columnWidth, indent)
 
 	for _, line := range offset.LineMetrics[1:] {
-		lines += (line.TotalLength() + columnWidth) / columnWidth
+		lines += wrappedRows(line.TotalLength(), columnWidth, indent)
 	}
 
 	return lines
 }
 
 func (m *StringMetrics) OffsetWithAddition(offset *StringMetrics, columnWidth uint32) uint32 {
+	return m.offsetWithAddition(offset, columnWidth, 0)
+}
+
+// offsetWithAddition is OffsetWithAddition with the rows offset's lines wrap onto indented by indent columns.
+func (m *StringMetrics) offsetWithAddition(offset *StringMetrics, columnWidth, indent uint32) uint32 {
 	if len(offset.LineMetrics) > 1 {
-		return offset.LineMetrics[len(offset.LineMetrics)-1].TotalLength() % columnWidth
+		return wrappedOffset(offset.LineMetrics[len(offset.LineMetrics)-1].TotalLength(), columnWidth, indent)
 	}
 
 	last := m.LineMetrics[len(m.LineMetrics)-1].TotalLength()
 	last += offset.LineMetrics[0].TotalLength()
-	return last % columnWidth
+	return wrappedOffset(last, columnWidth, indent)
+}
+
+// wrappedRows returns how many rows a line length columns long takes, with the rows it wraps onto indented by indent.
+// Like on the terminal, a line that fills its last row exactly goes on to the next one, that's where the cursor is.
+func wrappedRows(length, columnWidth, indent uint32) uint32 {
+	if columnWidth == 0 {
+		// Nowhere to wrap at, e.g. when the terminal size isn't known.
+		return 1
+	}
+	if indent >= columnWidth {
+		indent = 0
+	}
+	if length < columnWidth {
+		return 1
+	}
+	return 2 + (length-columnWidth)/(columnWidth-indent)
+}
+
+// wrappedOffset returns the column the end of a line length columns long is at, see wrappedRows.
+func wrappedOffset(length, columnWidth, indent uint32) uint32 {
+	if columnWidth == 0 {
+		return length
+	}
+	if indent >= columnWidth {
+		indent = 0
+	}
+	if length < columnWidth {
+		return length
+	}
+	return indent + (length-columnWidth)%(columnWidth-indent)
 }
 
 func (m *StringMetrics) Reset() {
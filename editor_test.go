@@ -0,0 +1,32 @@
+package line
+
+import "testing"
+
+func TestZeroColumns(t *testing.T) {
+	l := NewEditor().(*lineEditor)
+	prompt := l.ActualRenderedStringMetrics("> ")
+	buffer := l.ActualRenderedStringMetrics("some text\nand more")
+
+	// Nothing wraps without a width to wrap at.
+	if lines := prompt.LinesWithAddition(&buffer, 0); lines != 2 {
+		t.Errorf("%d lines, want 2", lines)
+	}
+	if offset := prompt.OffsetWithAddition(&buffer, 0); offset != 8 {
+		t.Errorf("ends at column %d, want 8", offset)
+	}
+	if lines := prompt.linesWithAddition(&buffer, 0, 2); lines != 2 {
+		t.Errorf("%d lines with an indent, want 2", lines)
+	}
+
+	// And the editor gets by with it too.
+	term := newTestTerminal(t, 24, 80)
+	l = newTestEditorOn(t, term)
+	l.numColumns = 0
+	feed(l, "some text")
+	if lines := l.NumLines(); lines != 1 {
+		t.Errorf("the editor takes %d lines, want 1", lines)
+	}
+	if line := l.cursorLine(); line != 1 {
+		t.Errorf("the cursor is on line %d, want 1", line)
+	}
+}
@@ -39,14 +39,12 @@ func main() {
 		interrupted = true
 		editor.Finish()
 	})
-	editor.SetTabCompletionHandler(func(_ line.Editor) []line.Completion {
-		l := editor.Line()
-		parts := strings.Split(l, " ")
-		if strings.HasPrefix("exit", parts[len(parts)-1]) {
+	editor.SetContextTabCompletionHandler(func(context line.CompletionContext, _ line.Editor) []line.Completion {
+		if strings.HasPrefix("exit", context.Prefix) {
 			return []line.Completion{
 				{
 					Text:                      "exit",
-					InvariantOffset:           uint32(len(parts[len(parts)-1])),
+					InvariantOffset:           uint32(len(context.Prefix)),
 					AllowCommitWithoutListing: true,
 				},
 			}
@@ -54,11 +52,11 @@ func main() {
 		return []line.Completion{
 			{
 				Text:         "lol no actual completions",
-				StaticOffset: uint32(len(parts[len(parts)-1])),
+				StaticOffset: uint32(len(context.Prefix)),
 			},
 			{
 				Text:         "no really, no actual completions",
-				StaticOffset: uint32(len(parts[len(parts)-1])),
+				StaticOffset: uint32(len(context.Prefix)),
 			},
 		}
 	})
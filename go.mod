@@ -2,4 +2,7 @@ module github.com/alimpfard/line
 
 go 1.17
 
-require golang.org/x/sys v0.0.0-20220429121018-84afa8d3f7b3
+require (
+	golang.org/x/sys v0.5.0
+	golang.org/x/text v0.13.0
+)
@@ -0,0 +1,107 @@
+package line
+
+import (
+	"os"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestEditor returns an editor in the state GetLine puts it in, editing an empty line after a "> " prompt
+// on an 80x24 test terminal, without going near the real terminal.
+func newTestEditor(t testing.TB) *lineEditor {
+	t.Helper()
+	return newTestEditorOn(t, newTestTerminal(t, 24, 80))
+}
+
+// newTestEditorOn is newTestEditor on term, with the prompt at its top-left corner.
+func newTestEditorOn(t testing.TB, term *testTerminal) *lineEditor {
+	t.Helper()
+	l := NewEditor().(*lineEditor)
+	l.numColumns = uint32(term.columns)
+	l.numLines = uint32(term.rows)
+	l.suggestionDisplay.setVTSize(l.numLines, l.numColumns)
+	// Test input never answers cursor position reports.
+	l.noCursorPositionReports = true
+	l.setDefaultKeybinds()
+	l.defaultKeybindsRegistered = true
+	l.laterChan = make(chan laterEventCode, 4)
+	l.loopChan = make(chan loopExitCode, 16)
+	l.isEditing = true
+
+	l.SetPrompt("> ")
+	l.Reset()
+	l.setOriginValue(1, 1)
+	l.refreshDisplay()
+	return l
+}
+
+// feed has the editor handle input as if it was typed, up to the end of it or the line being submitted.
+func feed(l *lineEditor, input string) {
+	l.incompleteData = append(l.incompleteData, input...)
+	for utf8.FullRune(l.incompleteData) && !l.finish {
+		l.tryUpdateOnce()
+	}
+}
+
+// withInput has fd 0, where the editor reads input from, be a pipe holding input for the rest of the test.
+func withInput(t testing.TB, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	readFrom(t, r)
+}
+
+// withReply is withInput, but with input only coming in a little while from now, like the terminal answering
+// a query would; anything the editor reads right away before asking doesn't get to it.
+func withReply(t testing.TB, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(replyDelay)
+		_, _ = w.WriteString(input)
+		w.Close()
+	}()
+	readFrom(t, r)
+}
+
+// withoutCursorPositionReports has the editor only wait a moment for cursor position reports that won't come,
+// for tests calling GetLine (which asks for one every time) on input that has none.
+func withoutCursorPositionReports(t testing.TB) {
+	timeout := dsrTimeout
+	dsrTimeout = time.Millisecond
+	t.Cleanup(func() {
+		dsrTimeout = timeout
+	})
+}
+
+// replyDelay is how long withReply's input takes to come in, well within dsrTimeout.
+const replyDelay = 50 * time.Millisecond
+
+// readFrom has fd 0 be r for the rest of the test.
+func readFrom(t testing.TB, r *os.File) {
+	t.Helper()
+	stdin, err := unix.Dup(unix.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Dup2(int(r.Fd()), unix.Stdin); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	t.Cleanup(func() {
+		_ = unix.Dup2(stdin, unix.Stdin)
+		_ = unix.Close(stdin)
+	})
+}
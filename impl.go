@@ -3,19 +3,28 @@ package line
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"golang.org/x/text/unicode/norm"
 	"io"
 	"os"
 	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
+type rawSequenceBinding struct {
+	sequence []rune
+	callback RawSequenceCallback
+}
+
 type maskEntry struct {
 	start uint32
 	mask  *Mask
@@ -39,9 +48,19 @@ type lineEditor struct {
 	returnedLine   string
 
 	cursor                            uint32
+	mark                              uint32
+	hasMark                           bool
+	killBuffer                        []rune
+	multilineMode                     bool
+	goalColumn                        uint32
+	goalColumnCursor                  uint32
+	hasGoalColumn                     bool
 	drawnCursor                       uint32
 	drawnEndOfLineOffset              uint32
 	inlineSearchCursor                uint32
+	historyStash                      []rune
+	historyStashCursor                uint32
+	hasHistoryStash                   bool
 	charsTouchedInTheMiddle           uint32
 	timesTabPressed                   uint32
 	numColumns                        uint32
@@ -61,15 +80,23 @@ type lineEditor struct {
 	suggestionDisplay              suggestionDisplay
 	rememberedSuggestionStaticData []rune
 
-	newPrompt string
+	newPrompt           string
+	basePrompt          string
+	promptStack         []string
+	header              []string
+	expandPromptEscapes bool
+	title               string
 
 	suggestionManager suggestionManager
 
-	alwaysRefresh bool
+	alwaysRefresh  bool
+	isSearchEditor bool
 
 	tabDirection tabDirection
 
 	keyCallbackMachine keyCallbackMachine
+	defaultKeybindings []KeyBinding
+	rawSequences       []rawSequenceBinding
 
 	termios                                unix.Termios
 	defaultTermios                         unix.Termios
@@ -81,15 +108,38 @@ type lineEditor struct {
 	historyCursor   uint32
 	historyCapacity uint32
 	historyDirty    bool
+	historyPath     string
+	// sessionHistoryStart is where the entries added since the last LoadHistory start.
+	sessionHistoryStart uint32
+	historySearchScope  HistorySearchScope
+	historyBoundary     HistoryBoundary
+	bufferDirty         bool
+	// bufferChanged is whether onBufferChanged has yet to hear of a change.
+	bufferChanged bool
+
+	// historyIndex is the entry the buffer was last loaded from, if hasHistoryIndex.
+	hasHistoryIndex bool
+	historyIndex    uint32
+	// nextHistoryIndex outlives the GetLine call that sets it (by accepting a line with ^O),
+	// it's the entry the next GetLine starts out with, if hasNextHistoryIndex.
+	hasNextHistoryIndex bool
+	nextHistoryIndex    uint32
 
 	state             inputState
 	previousFreeState inputState
 
 	drawnSpans   spans
 	currentSpans spans
+	inputStyle   Style
 
-	initialized   bool
-	refreshNeeded bool
+	suggestionStyle      Style
+	suggestionStyleStart uint32
+	suggestionStyleEnd   uint32
+	hasSuggestionStyle   bool
+
+	initialized               bool
+	defaultKeybindsRegistered bool
+	refreshNeeded             bool
 
 	isEditing                bool
 	prohibitInputProcessing  bool
@@ -99,10 +149,21 @@ type lineEditor struct {
 	laterChan  chan laterEventCode
 	signalChan chan os.Signal
 
+	// TriggerInterrupt may be called from any goroutine, it reaches the running GetLine through these,
+	// which each GetLine makes its own of under interruptMutex; done is closed once that GetLine returns.
+	interruptMutex sync.Mutex
+	interruptChan  chan struct{}
+	done           chan struct{}
+
 	onInterruptHandled   func()
 	tabCompletionHandler TabCompletionHandler
 	pasteHandler         PasteHandler
 	onRefresh            func(editor Editor)
+	onResize             func(newSize Winsize)
+	onBufferChanged      func(editor Editor)
+	inputLogger          InputLogger
+	titleCallback        func(editor Editor) string
+	controlCharRenderer  ControlCharRenderer
 
 	enableSignalHandling bool
 
@@ -110,11 +171,71 @@ type lineEditor struct {
 
 	inInterruptHandler              bool
 	interruptHandlerRequestedFinish bool
+	inRefreshHandler                bool
+	// isRefreshing is set while refreshDisplay is building up what to draw, see there.
+	isRefreshing bool
 
 	allowPanics          bool
 	enableBracketedPaste bool
+	enableFocusReporting bool
+	focusHandler         func(focused bool)
+
+	hasSelection        bool
+	selectionAnchor     uint32
+	selectionStyle      Style
+	hasDrawnSelection   bool
+	drawnSelectionStart uint32
+	drawnSelectionEnd   uint32
+
+	trimTrailingWhitespaceOnSubmit bool
+	normalization                  Normalization
+	bellStyle                      BellStyle
+	returnLineOnInterrupt          bool
+	keepEditingAfterInterrupt      bool
+	ctrlCIsInterrupt               bool
+	echoCtrlCOnInterrupt           bool
+	rawModeFlags                   RawModeFlags
+	minCompletionPrefix            uint32
+	tokenizer                      Tokenizer
+	lineWrapMode                   LineWrapMode
+	bleedStyleToEndOfLine          bool
+	placeholder                    []rune
+	placeholderStyle               Style
+	hasDrawnPlaceholder            bool
+	hintHandler                    func(line string, cursor uint32) string
+	hasDrawnHint                   bool
+	revealMasks                    bool
+	wrapIndent                     uint32
+	isScrolling                    bool
+	scrollStart                    uint32
+	scrollEnd                      uint32
+	pasteDetectionThreshold        int
+	lastDetectedPaste              time.Time
+	maxPasteSize                   int
+	// pastedLength is how much of the paste in progress made it in so far, see limitPaste.
+	pastedLength   int
+	pasteTruncated bool
+	// noCursorPositionReports is set once the terminal didn't report the cursor position in time, so as not
+	// to wait on it again for the rest of the line; it may well have been just slow, so GetLine asks again.
+	noCursorPositionReports bool
 }
 
+var ErrInterrupted = errors.New("interrupted")
+
+// ErrPanicked is what GetLine's error wraps when it recovers from a panic, see Config.AllowPanics.
+var ErrPanicked = errors.New("panicked while editing")
+
+// ErrNoCursorPositionReport is returned when the terminal doesn't answer a cursor position request in time.
+var ErrNoCursorPositionReport = errors.New("terminal did not report the cursor position")
+
+// dsrTimeout is how long we wait for the terminal to report the cursor position before giving up on it
+// (until the next GetLine, see noCursorPositionReports).
+var dsrTimeout = time.Second
+
+// rawSequenceTimeout is how long we wait for the rest of a raw sequence that the terminal's writes (or our reads)
+// cut short, before taking what's there for what it is.
+const rawSequenceTimeout = 50 * time.Millisecond
+
 type loopExitCode int
 type laterEventCode int
 
@@ -129,6 +250,12 @@ const (
 	laterEventCodeTryUpdateOnce
 )
 
+// The terminal size assumed when the terminal won't say what it is.
+const (
+	defaultNumColumns = 80
+	defaultNumLines   = 24
+)
+
 func (l *lineEditor) getTerminalSize() {
 	winsize, _ := unix.IoctlGetWinsize(unix.Stdout, unix.TIOCGWINSZ)
 	if winsize.Col == 0 || winsize.Row == 0 {
@@ -141,51 +268,92 @@ func (l *lineEditor) getTerminalSize() {
 
 	l.numColumns = uint32(winsize.Col)
 	l.numLines = uint32(winsize.Row)
+	if l.numColumns == 0 || l.numLines == 0 {
+		// Nothing would tell us the size (no terminal at all, or one that doesn't know), so go with the classic.
+		l.numColumns = defaultNumColumns
+		l.numLines = defaultNumLines
+	}
 }
 
-func editorInternal(fn func(editor *lineEditor)) func([]key, Editor) bool {
-	return func(_ []key, editor Editor) bool {
+func editorInternal(fn func(editor *lineEditor)) func([]KeyPress, Editor) bool {
+	return func(_ []KeyPress, editor Editor) bool {
 		fn(editor.(*lineEditor))
 		return false
 	}
 }
 
 func (l *lineEditor) setDefaultKeybinds() {
-	l.RegisterKeybinding([]key{{key: ctrl('N')}}, editorInternal(searchForwards))
-	l.RegisterKeybinding([]key{{key: ctrl('P')}}, editorInternal(searchBackwards))
-	l.RegisterKeybinding([]key{{key: ctrl('A')}}, editorInternal(goHome))
-	l.RegisterKeybinding([]key{{key: ctrl('B')}}, editorInternal(cursorLeftCharacter))
-	l.RegisterKeybinding([]key{{key: ctrl('D')}}, editorInternal(eraseCharacterForwards))
-	l.RegisterKeybinding([]key{{key: ctrl('E')}}, editorInternal(goEnd))
-	l.RegisterKeybinding([]key{{key: ctrl('F')}}, editorInternal(cursorRightCharacter))
+	l.defaultKeybindings = l.defaultKeybindings[:0]
+
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('N')}}, editorInternal(cursorDownLineOrSearchForwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('P')}}, editorInternal(cursorUpLineOrSearchBackwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('A')}}, editorInternal(goHome))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('B')}}, editorInternal(cursorLeftCharacter))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('D')}}, editorInternal(eraseSelectionOrCharacterForwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('E')}}, editorInternal(goEnd))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('F')}}, editorInternal(cursorRightCharacter))
 	// ^H: ctrl('H') = \b
-	l.RegisterKeybinding([]key{{key: ctrl('H')}}, editorInternal(eraseCharacterBackwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('H')}}, editorInternal(eraseSelectionOrCharacterBackwards))
 	// DEL, Some terminals send this instead of ^H
-	l.RegisterKeybinding([]key{{key: 127}}, editorInternal(eraseCharacterBackwards))
-	l.RegisterKeybinding([]key{{key: ctrl('K')}}, editorInternal(eraseToEnd))
-	l.RegisterKeybinding([]key{{key: ctrl('L')}}, editorInternal(clearScreen))
-	l.RegisterKeybinding([]key{{key: ctrl('R')}}, editorInternal(enterSearch))
-	l.RegisterKeybinding([]key{{key: ctrl('T')}}, editorInternal(transposeCharacters))
-	l.RegisterKeybinding([]key{{key: '\n'}}, editorInternal(finish))
-
-	l.RegisterKeybinding([]key{{key: ctrl('X')}, {key: ctrl('E')}}, editorInternal(editInExternalEditor))
+	l.registerDefaultKeybinding([]KeyPress{{key: 127}}, editorInternal(eraseSelectionOrCharacterBackwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('K')}}, editorInternal(eraseToEnd))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('L')}}, editorInternal(clearScreen))
+	// ^[^L: alt-^L: redraw the line without clearing the screen
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('L'), modifiers: ModifierAlt}}, editorInternal(redraw))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('R')}}, editorInternal(enterSearch))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('T')}}, editorInternal(transposeCharacters))
+	l.registerDefaultKeybinding([]KeyPress{{key: '\n'}}, editorInternal(finish))
+	// ^O: accept the line, and start the next one with the history entry after it
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('O')}}, editorInternal(operateAndGetNext))
+
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('X')}, {key: ctrl('E')}}, editorInternal(editInExternalEditor))
 
 	// ^[.: alt-.: insert last arg of previous command (similar to `!$` in shells)
-	l.RegisterKeybinding([]key{{key: '.', modifiers: ModifierAlt}}, editorInternal(insertLastWords))
+	l.registerDefaultKeybinding([]KeyPress{{key: '.', modifiers: ModifierAlt}}, editorInternal(insertLastWords))
 
-	l.RegisterKeybinding([]key{{key: 'b', modifiers: ModifierAlt}}, editorInternal(cursorLeftCharacter))
-	l.RegisterKeybinding([]key{{key: 'f', modifiers: ModifierAlt}}, editorInternal(cursorRightCharacter))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'b', modifiers: ModifierAlt}}, editorInternal(cursorLeftCharacter))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'f', modifiers: ModifierAlt}}, editorInternal(cursorRightCharacter))
 	// ^[^H: alt-backspace: backward delete word
-	l.RegisterKeybinding([]key{{key: '\b', modifiers: ModifierAlt}}, editorInternal(eraseAlnumWordBackwards))
-	l.RegisterKeybinding([]key{{key: 'd', modifiers: ModifierAlt}}, editorInternal(eraseAlnumWordForwards))
-	l.RegisterKeybinding([]key{{key: 'c', modifiers: ModifierAlt}}, editorInternal(capitalizeWord))
-	l.RegisterKeybinding([]key{{key: 'l', modifiers: ModifierAlt}}, editorInternal(lowercaseWord))
-	l.RegisterKeybinding([]key{{key: 'u', modifiers: ModifierAlt}}, editorInternal(uppercaseWord))
-	l.RegisterKeybinding([]key{{key: 't', modifiers: ModifierAlt}}, editorInternal(transposeWords))
+	l.registerDefaultKeybinding([]KeyPress{{key: '\b', modifiers: ModifierAlt}}, editorInternal(eraseAlnumWordBackwards))
+	// ^[^?: alt-backspace, for terminals whose backspace sends ^?
+	l.registerDefaultKeybinding([]KeyPress{{key: 127, modifiers: ModifierAlt}}, editorInternal(eraseAlnumWordBackwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'd', modifiers: ModifierAlt}}, editorInternal(eraseAlnumWordForwards))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'c', modifiers: ModifierAlt}}, editorInternal(capitalizeWord))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'l', modifiers: ModifierAlt}}, editorInternal(lowercaseWord))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'u', modifiers: ModifierAlt}}, editorInternal(uppercaseWord))
+	l.registerDefaultKeybinding([]KeyPress{{key: 't', modifiers: ModifierAlt}}, editorInternal(transposeWords))
+	// ^[m: alt-m: show or hide what's under masks
+	l.registerDefaultKeybinding([]KeyPress{{key: 'm', modifiers: ModifierAlt}}, editorInternal(toggleRevealMasks))
+
+	// ^@/^Space: set mark, ^X^X: exchange point and mark
+	l.registerDefaultKeybinding([]KeyPress{{key: 0}}, editorInternal(setMark))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('X')}, {key: ctrl('X')}}, editorInternal(exchangePointAndMark))
+	// ^W kills the region if there is one, and falls back to erasing a word otherwise.
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('W')}}, editorInternal(killRegion))
+	l.registerDefaultKeybinding([]KeyPress{{key: 'w', modifiers: ModifierAlt}}, editorInternal(copyRegion))
+	l.registerDefaultKeybinding([]KeyPress{{key: ctrl('Y')}}, editorInternal(yank))
+
+	// These go last, so they can see what's already bound.
+	l.registerTerminalKeybinding(l.termios.Cc[syscall.VWERASE], editorInternal(eraseWordBackwards))
+	l.registerTerminalKeybinding(l.termios.Cc[syscall.VKILL], editorInternal(killLine))
+	l.registerTerminalKeybinding(l.termios.Cc[syscall.VERASE], editorInternal(eraseSelectionOrCharacterBackwards))
+}
+
+// registerTerminalKeybinding binds one of the terminal's special characters, unless the terminal has it
+// disabled, or it's the same as a key with an explicit default binding (e.g. VWERASE being ^W).
+func (l *lineEditor) registerTerminalKeybinding(c uint8, binding KeybindingCallback) {
+	// 0 and 0xff are what Linux and the BSDs use for _POSIX_VDISABLE respectively.
+	if c == 0 || c == 0xff {
+		return
+	}
 
-	l.RegisterKeybinding([]key{{key: uint32(l.termios.Cc[syscall.VWERASE])}}, editorInternal(eraseWordBackwards))
-	l.RegisterKeybinding([]key{{key: uint32(l.termios.Cc[syscall.VKILL])}}, editorInternal(killLine))
-	l.RegisterKeybinding([]key{{key: uint32(l.termios.Cc[syscall.VERASE])}}, editorInternal(eraseCharacterBackwards))
+	keys := []KeyPress{{key: uint32(c)}}
+	for _, defaultBinding := range l.defaultKeybindings {
+		if keysEqual(defaultBinding.keys, keys) {
+			return
+		}
+	}
+	l.registerDefaultKeybinding(keys, binding)
 }
 
 func (l *lineEditor) handleInterruptEvent() {
@@ -199,7 +367,9 @@ func (l *lineEditor) handleInterruptEvent() {
 
 	l.previousInterruptWasHandledAsInterrupt = true
 
-	_, _ = os.Stderr.Write([]byte("^C"))
+	if l.echoCtrlCOnInterrupt {
+		_, _ = os.Stderr.Write([]byte("^C"))
+	}
 
 	if l.onInterruptHandled != nil {
 		l.inInterruptHandler = true
@@ -214,47 +384,152 @@ func (l *lineEditor) handleInterruptEvent() {
 		return
 	}
 
-	l.buffer = make([]rune, 0)
-	l.charsTouchedInTheMiddle = 0
-	l.cursor = 0
+	if l.onInterruptHandled != nil && l.keepEditingAfterInterrupt {
+		// The handler dealt with it, keep the line and carry on editing; redraw over the ^C.
+		l.refreshNeeded = true
+		return
+	}
+
+	if l.returnLineOnInterrupt {
+		l.inputError = ErrInterrupted
+	} else {
+		l.buffer = make([]rune, 0)
+		l.charsTouchedInTheMiddle = 0
+		l.cursor = 0
+	}
 
 	l.Finish()
 }
 
 func (l *lineEditor) cursorLine() uint32 {
-	cursor := l.drawnCursor
-	if cursor > l.cursor {
-		cursor = l.cursor
-	}
-	metrics := l.actualRenderedStringMetricsImpl(string(l.buffer[:cursor]), l.currentMasks)
-	return l.CurrentPromptMetrics().LinesWithAddition(&metrics, l.numColumns)
+	line, _ := l.lineAndOffsetOf(min(l.drawnCursor, l.cursor))
+	return line
 }
 
 func (l *lineEditor) offsetInLine() uint32 {
-	cursor := l.drawnCursor
-	if cursor > l.cursor {
-		cursor = l.cursor
+	_, offset := l.lineAndOffsetOf(min(l.drawnCursor, l.cursor))
+	return offset
+}
+
+// visibleMasks returns the masks the buffer is drawn with, there are none while they're revealed.
+func (l *lineEditor) visibleMasks() []maskEntry {
+	if l.revealMasks {
+		return nil
 	}
-	metrics := l.actualRenderedStringMetricsImpl(string(l.buffer[:cursor]), l.currentMasks)
-	return l.CurrentPromptMetrics().OffsetWithAddition(&metrics, l.numColumns)
+	return l.currentMasks
 }
 
-func (l *lineEditor) ensureFreeLinesFromOrigin(count uint32) {
-	if count > l.numLines {
-		// It's hopeless...
-		if l.allowPanics {
-			panic("ensureFreeLinesFromOrigin: count > l.numLines")
-		} else {
-			count = l.numLines
+// bufferMetrics measures the buffer up to offset as it is drawn; when scrolling sideways,
+// that is only the part of it that's visible, along with the ellipses marking what's cut off.
+func (l *lineEditor) bufferMetrics(offset uint32) StringMetrics {
+	if !l.isScrolling {
+		return l.actualRenderedStringMetricsImpl(string(l.buffer[:offset]), l.visibleMasks())
+	}
+
+	length := uint32(0)
+	if l.scrollStart > 0 {
+		length++
+	}
+	if offset > l.scrollStart {
+		length += l.bufferWidth(min(offset, l.scrollEnd)) - l.bufferWidth(l.scrollStart)
+	}
+	if offset == uint32(len(l.buffer)) && l.scrollEnd < offset {
+		length++
+	}
+	return StringMetrics{LineMetrics: []LineMetrics{{Length: length}}, TotalLength: length, MaxLineLength: length}
+}
+
+// bufferWidth returns how many columns the (single line) buffer takes up to offset.
+func (l *lineEditor) bufferWidth(offset uint32) uint32 {
+	metrics := l.actualRenderedStringMetricsImpl(string(l.buffer[:offset]), l.visibleMasks())
+	return metrics.LineMetrics[len(metrics.LineMetrics)-1].TotalLength()
+}
+
+// updateScroll picks the part of the buffer to show when scrolling sideways, so that the cursor stays in view.
+// It returns whether that changed from what was drawn last.
+func (l *lineEditor) updateScroll() bool {
+	wasScrolling, oldStart, oldEnd := l.isScrolling, l.scrollStart, l.scrollEnd
+	l.isScrolling = false
+
+	if l.lineWrapMode != LineWrapModeScroll || l.numColumns == 0 {
+		return wasScrolling
+	}
+
+	promptMetrics := l.CurrentPromptMetrics()
+	promptWidth := promptMetrics.LineMetrics[len(promptMetrics.LineMetrics)-1].TotalLength() % l.numColumns
+	length := uint32(len(l.buffer))
+	// Leave the last column alone, writing there would have the terminal wrap anyway.
+	available := int64(l.numColumns) - int64(promptWidth) - 1
+	if available > 3 && strings.IndexRune(string(l.buffer), '\n') == -1 && l.bufferWidth(length) > uint32(available) {
+		// One column on each side is kept for the ellipses.
+		budget := uint32(available) - 2
+		start := min(l.scrollStart, l.cursor)
+		if !wasScrolling {
+			start = 0
+		}
+		fits := func(from, to uint32) bool {
+			return l.bufferWidth(to)-l.bufferWidth(from) <= budget
+		}
+		if !fits(start, l.cursor) {
+			start = l.cursor - uint32(sort.Search(int(l.cursor-start), func(i int) bool {
+				return !fits(l.cursor-uint32(i)-1, l.cursor)
+			}))
 		}
+		// Don't leave empty space at the end if there's more to show at the start.
+		if fits(start, length) {
+			start -= uint32(sort.Search(int(start), func(i int) bool {
+				return !fits(start-uint32(i)-1, length)
+			}))
+		}
+		end := start + uint32(sort.Search(int(length-start), func(i int) bool {
+			return !fits(start, start+uint32(i)+1)
+		}))
+
+		l.isScrolling = true
+		l.scrollStart = start
+		l.scrollEnd = end
+	}
+
+	return l.isScrolling != wasScrolling || l.isScrolling && (l.scrollStart != oldStart || l.scrollEnd != oldEnd)
+}
+
+// lineAndOffsetOf returns the (1-based) line and column offset in that line
+// a buffer offset is drawn at, relative to the start of the prompt.
+func (l *lineEditor) lineAndOffsetOf(offset uint32) (uint32, uint32) {
+	metrics := l.bufferMetrics(offset)
+	promptMetrics := l.CurrentPromptMetrics()
+	return promptMetrics.linesWithAddition(&metrics, l.numColumns, l.wrapIndent), promptMetrics.offsetWithAddition(&metrics, l.numColumns, l.wrapIndent)
+}
+
+func (l *lineEditor) PositionOf(offset uint32) (row, col uint32) {
+	line, column := l.lineAndOffsetOf(min(offset, uint32(len(l.buffer))))
+	return line - 1 + l.originRow, column + l.originColumn
+}
+
+// CursorRow returns the terminal row (1-based) the cursor is on, it is only meaningful while editing.
+func (l *lineEditor) CursorRow() uint32 {
+	return l.cursorLine() - 1 + l.originRow
+}
+
+// CursorColumn returns the terminal column (1-based) the cursor is on, it is only meaningful while editing.
+func (l *lineEditor) CursorColumn() uint32 {
+	return l.offsetInLine() + l.originColumn
+}
+
+func (l *lineEditor) ensureFreeLinesFromOrigin(stream io.Writer, count uint32) {
+	if count > l.numLines {
+		// It's hopeless, but that's easy to hit on a tiny terminal,
+		// so make do with what we have instead of giving up.
+		count = l.numLines
 	}
 
-	if l.originRow+count <= l.numLines {
+	// The lines go from originRow to originRow+count-1.
+	if l.originRow+count <= l.numLines+1 {
 		return
 	}
 
 	diff := l.originRow + count - l.numLines - 1
-	os.Stderr.Write([]byte(fmt.Sprintf("\x1b[%dS", diff)))
+	fmt.Fprintf(stream, "\x1b[%dS", diff)
 	l.originRow -= diff
 	l.refreshNeeded = false
 	l.charsTouchedInTheMiddle = 0
@@ -273,7 +548,7 @@ func (l *lineEditor) repositionCursor(stream io.Writer, toEnd bool) {
 	line := l.cursorLine() - 1
 	column := l.offsetInLine()
 
-	l.ensureFreeLinesFromOrigin(line)
+	l.ensureFreeLinesFromOrigin(stream, line+1)
 
 	vtMoveAbsolute(line+l.originRow, column+l.originColumn, stream)
 
@@ -285,11 +560,35 @@ func (l *lineEditor) restore() {
 	if l.enableBracketedPaste {
 		os.Stderr.Write([]byte("\x1b[?2004l"))
 	}
+	if l.enableFocusReporting {
+		os.Stderr.Write([]byte("\x1b[?1004l"))
+	}
 	l.initialized = false
 }
 
+// visibleBellDuration is how long the screen stays flashed for BellStyleVisible.
+const visibleBellDuration = 100 * time.Millisecond
+
+func (l *lineEditor) ringBell() {
+	switch l.bellStyle {
+	case BellStyleAudible:
+		_, _ = os.Stderr.Write([]byte("\a"))
+	case BellStyleVisible:
+		// Flip the whole screen to reverse video and back.
+		_, _ = os.Stderr.Write([]byte("\x1b[?5h"))
+		time.Sleep(visibleBellDuration)
+		_, _ = os.Stderr.Write([]byte("\x1b[?5l"))
+	}
+}
+
 func (l *lineEditor) setOrigin(quitOnError bool) bool {
 	row, col, err := l.vtDSR()
+	if err == ErrNoCursorPositionReport {
+		// Not much we can do about a terminal that won't tell us, carry on from the row we last knew
+		// of rather than hang or give up on editing altogether.
+		l.setOriginValue(max(l.originRow, 1), 1)
+		return true
+	}
 	if err == nil {
 		l.setOriginValue(row, col)
 		return true
@@ -307,15 +606,16 @@ func (l *lineEditor) setOriginValue(row uint32, col uint32) {
 	l.suggestionDisplay.setOrigin(row, col)
 }
 
-func (l *lineEditor) vtDSR() (uint32, uint32, error) {
+// readPendingInput reads whatever input is available right now into incompleteData, without waiting for more.
+func (l *lineEditor) readPendingInput() {
 	buf := make([]byte, 16)
 	moreJunkToRead := false
 	readFds := unix.FdSet{}
-	readFds.Set(unix.Stdin)
 	timeout := unix.Timeval{}
 
 	for {
 		moreJunkToRead = false
+		readFds.Set(unix.Stdin)
 		_, _ = unix.Select(1, &readFds, nil, nil, &timeout)
 		if readFds.IsSet(unix.Stdin) {
 			nread, err := unix.Read(unix.Stdin, buf)
@@ -335,11 +635,41 @@ func (l *lineEditor) vtDSR() (uint32, uint32, error) {
 			break
 		}
 	}
+}
+
+// waitForInput reads whatever comes in within timeout onto incompleteData, and returns whether anything did.
+func (l *lineEditor) waitForInput(timeout time.Duration) bool {
+	readFds := unix.FdSet{}
+	readFds.Set(unix.Stdin)
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if n, err := unix.Select(1, &readFds, nil, nil, &tv); err != nil || n == 0 {
+		return false
+	}
+
+	buf := make([]byte, 16)
+	nread, err := unix.Read(unix.Stdin, buf)
+	if err != nil || nread <= 0 {
+		return false
+	}
+	l.incompleteData = append(l.incompleteData, buf[:nread]...)
+	if l.inputLogger != nil {
+		l.inputLogger(buf[:nread], "read")
+	}
+	return true
+}
+
+func (l *lineEditor) vtDSR() (uint32, uint32, error) {
+	l.readPendingInput()
 
 	if l.inputError != nil {
 		return 0, 0, l.inputError
 	}
 
+	if l.noCursorPositionReports {
+		// This terminal didn't answer before, don't wait on it again.
+		return 1, 1, ErrNoCursorPositionReport
+	}
+
 	_, _ = os.Stderr.WriteString("\x1b[6n")
 
 	const (
@@ -358,10 +688,26 @@ func (l *lineEditor) vtDSR() (uint32, uint32, error) {
 	row := uint32(1)
 	col := uint32(1)
 
+	deadline := time.Now().Add(dsrTimeout)
+
 	for {
 		if state == SawR {
 			break
 		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			l.noCursorPositionReports = true
+			return 1, 1, ErrNoCursorPositionReport
+		}
+		readFds := unix.FdSet{}
+		readFds.Set(unix.Stdin)
+		timeout := unix.NsecToTimeval(remaining.Nanoseconds())
+		n, err := unix.Select(1, &readFds, nil, nil, &timeout)
+		if err != nil || n == 0 {
+			continue
+		}
+
 		c := make([]byte, 1)
 		nread, err := os.Stdin.Read(c)
 		if err != nil {
@@ -470,12 +816,24 @@ func (l *lineEditor) interrupted() {
 		return
 	}
 
-	if !l.finish || !l.previousInterruptWasHandledAsInterrupt {
+	if !l.finish {
+		// Editing goes on (e.g. the interrupt handler chose to keep the line), show whatever changed.
+		l.refreshDisplay()
+		return
+	}
+
+	if !l.previousInterruptWasHandledAsInterrupt {
 		return
 	}
 
 	l.finish = false
 
+	if l.returnLineOnInterrupt {
+		// Hand the partial line back to the caller instead of starting over.
+		l.reallyQuitEventLoop()
+		return
+	}
+
 	l.repositionCursor(os.Stderr, true)
 	if l.suggestionDisplay.cleanup() {
 		l.repositionCursor(os.Stderr, true)
@@ -489,6 +847,26 @@ func (l *lineEditor) interrupted() {
 	l.loopChan <- loopExitCodeRetry
 }
 
+// TriggerInterrupt has the line being edited interrupted as if by ^C, interrupt handler and all.
+// It does nothing unless a line is being edited, and may be called from any goroutine.
+func (l *lineEditor) TriggerInterrupt() {
+	l.interruptMutex.Lock()
+	interrupts, done := l.interruptChan, l.done
+	l.interruptMutex.Unlock()
+	if done == nil {
+		// GetLine was never called.
+		return
+	}
+
+	select {
+	case <-done:
+		// GetLine has returned, there's nothing to interrupt.
+	case interrupts <- struct{}{}:
+	default:
+		// There's an interrupt waiting to be handled already, that's the one this would have been.
+	}
+}
+
 func (l *lineEditor) resized() {
 	l.wasResized = true
 	l.previousNumColumns = l.numColumns
@@ -517,7 +895,10 @@ func (l *lineEditor) handleResizeEvent(resetOrigin bool) {
 		return
 	}
 
-	l.setOriginValue(l.originRow, 1)
+	l.recalculateOrigin()
+
+	// Redraw everything for the new size, the suggestions go on top of that.
+	l.refreshDisplay()
 	l.repositionCursor(os.Stderr, true)
 	l.suggestionDisplay.redisplay(l.suggestionManager, l.numLines, l.numColumns)
 	l.originRow = l.suggestionDisplay.originRow()
@@ -526,6 +907,96 @@ func (l *lineEditor) handleResizeEvent(resetOrigin bool) {
 	if l.isSearching {
 		l.searchEditor.resized()
 	}
+
+	if l.onResize != nil {
+		l.onResize(l.TerminalSize())
+		// Draw whatever the handler changed (a header, say) right away, there may not be a keypress for a while.
+		if l.refreshNeeded {
+			l.refreshDisplay()
+		}
+	}
+}
+
+// Redraw draws the prompt and buffer from scratch on the line the cursor is on, for when something else
+// wrote over them or a resize went unnoticed; unlike ^L, nothing is cleared above the prompt.
+func (l *lineEditor) Redraw() {
+	if l.isRefreshing {
+		// Called from a handler in the middle of a refresh, which can just as well redraw everything
+		// itself, there's half a refresh waiting to be written out that mustn't be drawn over.
+		l.cachedPromptValid = false
+		l.refreshNeeded = true
+		l.charsTouchedInTheMiddle++
+		return
+	}
+
+	if l.suggestionDisplay.cleanup() {
+		l.repositionCursor(os.Stderr, false)
+	}
+
+	// Whatever we drew may not be where we think it is anymore (e.g. moved along by something else writing to
+	// the terminal), so ask the terminal where the cursor is: it's on the line being edited, which starts however
+	// many lines above that it was drawn with. A terminal that won't say leaves us with the origin we had.
+	if row, _, err := l.vtDSR(); err == nil {
+		l.setOriginValue(row, 1)
+		l.recalculateOrigin()
+	}
+
+	l.getTerminalSize()
+	l.suggestionDisplay.setVTSize(l.numLines, l.numColumns)
+	l.previousNumColumns = l.numColumns
+	l.wasResized = false
+
+	vtMoveAbsolute(l.originRow, 1, os.Stderr)
+	vtClearToEndOfScreen(os.Stderr)
+
+	l.extraForwardLines = 0
+	l.cachedPromptValid = false
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
+	l.refreshDisplay()
+}
+
+// SuspendAndRun gives the terminal back for as long as fn runs, e.g. to run another program in it, and picks up
+// editing (if it was) below whatever that left on screen.
+func (l *lineEditor) SuspendAndRun(fn func() error) error {
+	wasEditing := l.isEditing
+	if wasEditing {
+		// Move below whatever we've drawn so the subprocess gets a clean slate.
+		l.repositionCursor(os.Stderr, true)
+		if l.suggestionDisplay.cleanup() {
+			l.repositionCursor(os.Stderr, true)
+		}
+		_, _ = os.Stderr.Write([]byte("\n"))
+	}
+
+	wasInitialized := l.initialized
+	if wasInitialized {
+		l.restore()
+	}
+
+	err := fn()
+
+	if wasInitialized {
+		_ = setTermios(&l.termios)
+		if l.enableBracketedPaste {
+			os.Stderr.Write([]byte("\x1b[?2004h"))
+		}
+		if l.enableFocusReporting {
+			os.Stderr.Write([]byte("\x1b[?1004h"))
+		}
+		l.initialized = true
+	}
+
+	if wasEditing {
+		l.getTerminalSize()
+		l.suggestionDisplay.setVTSize(l.numLines, l.numColumns)
+		l.setOrigin(false)
+		l.cachedPromptValid = false
+		l.refreshNeeded = true
+		l.refreshDisplay()
+	}
+
+	return err
 }
 
 func (l *lineEditor) Initialize() {
@@ -538,12 +1009,15 @@ func (l *lineEditor) Initialize() {
 
 	l.getTerminalSize()
 
-	t.Lflag &^= unix.ECHO | unix.ICANON
-	_ = setTermios(t)
-
-	l.termios = *t
+	l.termios = l.rawTermios()
+	_ = setTermios(&l.termios)
 
-	l.setDefaultKeybinds()
+	// Only register the defaults once, re-initializing must not clobber
+	// bindings the user changed or disabled since.
+	if !l.defaultKeybindsRegistered {
+		l.setDefaultKeybinds()
+		l.defaultKeybindsRegistered = true
+	}
 	l.initialized = true
 }
 
@@ -592,8 +1066,22 @@ func vtMoveRelative(row, col int64, w io.Writer) {
 	}
 }
 
-func (l *lineEditor) GetLine(prompt string) (string, error) {
+func (l *lineEditor) GetLine(prompt string) (line string, err error) {
 	l.Initialize()
+	defer func() {
+		if r := recover(); r != nil {
+			// Something (most likely a user callback) blew up, don't leave the terminal raw and styled behind us.
+			vtApplyStyle(StyleReset, os.Stderr, true)
+			if l.initialized {
+				l.restore()
+			}
+			l.isEditing = false
+			if l.allowPanics {
+				panic(r)
+			}
+			line, err = "", fmt.Errorf("%w: %v", ErrPanicked, r)
+		}
+	}()
 	l.isEditing = true
 	oldCols := l.numColumns
 	oldLines := l.numLines
@@ -602,6 +1090,12 @@ func (l *lineEditor) GetLine(prompt string) (string, error) {
 	if l.enableBracketedPaste {
 		os.Stderr.Write([]byte("\x1b[?2004h"))
 	}
+	if l.enableFocusReporting {
+		os.Stderr.Write([]byte("\x1b[?1004h"))
+	}
+
+	// Put the keypad in numeric mode so it sends plain digits where it can.
+	os.Stderr.Write([]byte("\x1b>"))
 
 	if l.numColumns != oldCols || l.numLines != oldLines {
 		l.refreshNeeded = true
@@ -616,22 +1110,38 @@ func (l *lineEditor) GetLine(prompt string) (string, error) {
 		_, _ = os.Stderr.Write([]byte("\n"))
 	}
 	vtMoveRelative(-int64(promptLines), 0, os.Stderr)
+	l.noCursorPositionReports = false
 	l.setOrigin(true)
 
 	l.historyCursor = uint32(len(l.history))
+	l.hasHistoryIndex = false
+
+	if l.hasNextHistoryIndex {
+		// The previous line was accepted with ^O, carry on with the entry after it.
+		l.hasNextHistoryIndex = false
+		if l.nextHistoryIndex < uint32(len(l.history)) {
+			l.InsertString(l.history[l.nextHistoryIndex].entry)
+			l.historyIndex = l.nextHistoryIndex
+			l.hasHistoryIndex = true
+			l.bufferDirty = false
+		}
+	}
 
 	l.refreshDisplay()
 
 	l.loopChan = make(chan loopExitCode, 1)
-	defer close(l.loopChan)
-
 	l.laterChan = make(chan laterEventCode, 4)
-	defer close(l.laterChan)
 
+	l.interruptMutex.Lock()
+	l.interruptChan = make(chan struct{}, 1)
+	l.done = make(chan struct{})
+	l.interruptMutex.Unlock()
+	defer close(l.done)
+
+	// Keep to this GetLine's channels, a retry after an interrupt makes new ones; once it has returned,
+	// there's no one left to tell about input.
+	loopChan, laterChan, done := l.loopChan, l.laterChan, l.done
 	go func() {
-		defer func() {
-			recover()
-		}()
 		for {
 			fds := unix.FdSet{}
 			fds.Set(unix.Stdin)
@@ -642,8 +1152,11 @@ func (l *lineEditor) GetLine(prompt string) (string, error) {
 					continue
 				}
 				l.inputError = err
-				l.loopChan <- loopExitCodeExit
-				break
+				select {
+				case <-done:
+				case loopChan <- loopExitCodeExit:
+				}
+				return
 			}
 			if n == 0 {
 				continue
@@ -652,7 +1165,11 @@ func (l *lineEditor) GetLine(prompt string) (string, error) {
 				continue
 			}
 
-			l.laterChan <- laterEventCodeTryUpdateOnce
+			select {
+			case <-done:
+				return
+			case laterChan <- laterEventCodeTryUpdateOnce:
+			}
 		}
 	}()
 
@@ -695,6 +1212,11 @@ func (l *lineEditor) GetLine(prompt string) (string, error) {
 				l.tryUpdateOnce()
 				continue
 			}
+		case <-l.interruptChan:
+			if l.finish {
+				continue
+			}
+			l.interrupted()
 		case code := <-l.loopChan:
 			if code == loopExitCodeExit {
 				l.finish = false
@@ -712,6 +1234,26 @@ func (l *lineEditor) AddToHistory(line string) {
 		entry:     line,
 		timestamp: time.Now().Unix(),
 	})
+	l.historyDirty = true
+	l.trimHistory()
+}
+
+// trimHistory drops the oldest entries that don't fit in historyCapacity.
+func (l *lineEditor) trimHistory() {
+	if l.historyCapacity == 0 || uint32(len(l.history)) <= l.historyCapacity {
+		return
+	}
+
+	dropped := uint32(len(l.history)) - l.historyCapacity
+	l.history = append(l.history[:0], l.history[dropped:]...)
+	l.sessionHistoryStart -= min(dropped, l.sessionHistoryStart)
+	l.historyCursor -= min(dropped, l.historyCursor)
+	// The entries the buffer came from, and the one ^O asked for next, may be gone too.
+	l.hasHistoryIndex = l.hasHistoryIndex && l.historyIndex >= dropped
+	l.historyIndex -= min(dropped, l.historyIndex)
+	l.hasNextHistoryIndex = l.hasNextHistoryIndex && l.nextHistoryIndex >= dropped
+	l.nextHistoryIndex -= min(dropped, l.nextHistoryIndex)
+	l.historyDirty = true
 }
 
 func (l *lineEditor) LoadHistory(path string) error {
@@ -722,15 +1264,47 @@ func (l *lineEditor) LoadHistory(path string) error {
 	}
 	defer f.Close()
 
+	// Whatever was in the history before isn't in the file.
+	dirty := l.historyDirty || len(l.history) != 0
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		l.AddToHistory(scanner.Text())
 	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.historyDirty = dirty
+	l.historyPath = path
+	l.sessionHistoryStart = uint32(len(l.history))
+	return nil
+}
+
+func (l *lineEditor) SetHistorySearchScope(scope HistorySearchScope) {
+	l.historySearchScope = scope
+}
+
+func (l *lineEditor) SetHistoryBoundary(boundary HistoryBoundary) {
+	l.historyBoundary = boundary
+}
+
+func (l *lineEditor) SetBellStyle(style BellStyle) {
+	l.bellStyle = style
+}
 
-	return scanner.Err()
+// SetHistoryCapacity keeps at most capacity history entries, dropping the oldest ones to make room.
+// 0 (the default) keeps every entry.
+func (l *lineEditor) SetHistoryCapacity(capacity uint32) {
+	l.historyCapacity = capacity
+	l.trimHistory()
 }
 
 func (l *lineEditor) SaveHistory(path string) error {
+	if !l.historyDirty && path == l.historyPath {
+		// The file already has exactly what we have.
+		return nil
+	}
+
 	// FIXME: Support the LibLine history format.
 	f, err := os.Create(path)
 	if err != nil {
@@ -745,49 +1319,207 @@ func (l *lineEditor) SaveHistory(path string) error {
 		}
 	}
 
+	l.historyDirty = false
+	l.historyPath = path
 	return nil
 }
 
-func (l *lineEditor) RegisterKeybinding(keys []key, binding KeybindingCallback) {
+// IsDirty returns whether the buffer was changed since GetLine started.
+func (l *lineEditor) IsDirty() bool {
+	return l.bufferDirty
+}
+
+// markBufferChanged notes that the contents of the buffer changed.
+func (l *lineEditor) markBufferChanged() {
+	l.bufferDirty = true
+	l.bufferChanged = true
+}
+
+func (l *lineEditor) RegisterKeybinding(keys []KeyPress, binding KeybindingCallback) {
 	l.keyCallbackMachine.registerInputCallback(keys, binding)
 }
 
-type VTState int
+// RegisterKeybindingString binds the keys spec stands for, see ParseKeys.
+func (l *lineEditor) RegisterKeybindingString(spec string, binding KeybindingCallback) error {
+	keys, err := ParseKeys(spec)
+	if err != nil {
+		return err
+	}
+	l.registerParsedKeybinding(keys, binding)
+	return nil
+}
 
-const (
-	VTStateFree VTState = iota
-	VTStateEscape
-	VTStateBracket
-	VTStateBracketArgsSemi
-	VTStateTitle
-)
+// registerParsedKeybinding binds keys as ParseKeys gave them, which may well be an escape sequence.
+func (l *lineEditor) registerParsedKeybinding(keys []KeyPress, binding KeybindingCallback) {
+	isSS3 := len(keys) > 1 && keys[0] == Alt('O') && keys[1].modifiers == 0 && isSS3Final(rune(keys[1].key))
+	if len(keys) > 1 && keys[0] == Alt('[') || isSS3 {
+		// These are escape sequences (arrow keys and such), which are handled before they
+		// could ever reach the keybindings, so catch them as they come in instead.
+		// Alt-O followed by anything else is just that, see the handling of ^[O.
+		l.RegisterRawSequence(keysSequence(keys), func(_ []byte, editor Editor) {
+			binding(keys, editor)
+		})
+		return
+	}
+	l.RegisterKeybinding(keys, binding)
+}
 
-func (l *lineEditor) ActualRenderedStringMetrics(line string) StringMetrics {
-	return l.actualRenderedStringMetricsImpl(line, []maskEntry{})
+// LoadKeybindings binds keys to actions as the inputrc-like file at path says to, one per line:
+//
+//	# Comments start with '#'.
+//	"\C-w": backward-kill-word
+//	M-b: backward-word
+//
+// The keys are as ParseKeys reads them, the actions as Action names them; readline's own "set" and "$if"
+// lines are skipped. Nothing is bound unless the whole file is read fine.
+func (l *lineEditor) LoadKeybindings(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	type binding struct {
+		keys   []KeyPress
+		action KeybindingCallback
+	}
+	var bindings []binding
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == '$' || strings.HasPrefix(line, "set ") {
+			continue
+		}
+
+		separator := strings.LastIndexByte(line, ':')
+		if separator == -1 {
+			return fmt.Errorf("%s:%d: expected \"keys: action\"", path, i+1)
+		}
+		keys, err := ParseKeys(line[:separator])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		name := strings.TrimSpace(line[separator+1:])
+		action := Action(name)
+		if action == nil {
+			return fmt.Errorf("%s:%d: unknown action %q", path, i+1, name)
+		}
+		bindings = append(bindings, binding{keys, action})
+	}
+
+	for _, b := range bindings {
+		l.registerParsedKeybinding(b.keys, b.action)
+	}
+	return nil
 }
 
-func (l *lineEditor) actualRenderedStringMetricsImpl(line string, masks []maskEntry) StringMetrics {
-	metrics := StringMetrics{}
-	currentLine := LineMetrics{}
-	state := VTStateFree
-	runes := []rune(line)
-	byteOffset := 0
-	var mask *Mask
-	maskIt := 0
+func (l *lineEditor) RegisterRawSequence(sequence []byte, callback RawSequenceCallback) {
+	runes := []rune(string(sequence))
+	if len(runes) == 0 {
+		return
+	}
 
-	for i := 0; i < len(runes); i++ {
-		c := runes[i]
-		if maskIt < len(masks) && masks[maskIt].start <= uint32(i) {
-			mask = masks[maskIt].mask
+	for i, binding := range l.rawSequences {
+		if string(binding.sequence) == string(runes) {
+			l.rawSequences[i].callback = callback
+			return
 		}
+	}
+	l.rawSequences = append(l.rawSequences, rawSequenceBinding{runes, callback})
+}
 
-		if mask != nil && mask.mode == MaskModeReplaceEntireSelection {
-			maskIt++
-			actualEndOffset := uint32(len(runes))
-			if maskIt < len(masks) {
-				actualEndOffset = masks[maskIt].start
-			}
-			endOffset := min(actualEndOffset, uint32(len(runes)))
+// continuesRawSequence returns whether input is the start of a registered raw sequence longer than it.
+func (l *lineEditor) continuesRawSequence(input []rune) bool {
+	for _, binding := range l.rawSequences {
+		if len(binding.sequence) > len(input) && string(binding.sequence[:len(input)]) == string(input) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRawSequence returns the longest registered raw sequence that input starts with.
+func (l *lineEditor) findRawSequence(input []rune) *rawSequenceBinding {
+	var match *rawSequenceBinding
+	for i := range l.rawSequences {
+		binding := &l.rawSequences[i]
+		if len(binding.sequence) > len(input) || string(input[:len(binding.sequence)]) != string(binding.sequence) {
+			continue
+		}
+		if match == nil || len(binding.sequence) > len(match.sequence) {
+			match = binding
+		}
+	}
+	return match
+}
+
+func (l *lineEditor) registerDefaultKeybinding(keys []KeyPress, binding KeybindingCallback) {
+	l.defaultKeybindings = append(l.defaultKeybindings, KeyBinding{keys, binding})
+	l.RegisterKeybinding(keys, binding)
+}
+
+func (l *lineEditor) UnregisterKeybinding(keys []KeyPress) {
+	l.keyCallbackMachine.unregisterInputCallback(keys)
+}
+
+func (l *lineEditor) DisableKeybinding(keys []KeyPress) {
+	l.keyCallbackMachine.disableInputCallback(keys)
+}
+
+func (l *lineEditor) RestoreDefaultKeybinding(keys []KeyPress) {
+	for _, binding := range l.defaultKeybindings {
+		if keysEqual(binding.keys, keys) {
+			l.RegisterKeybinding(binding.keys, binding.binding)
+			return
+		}
+	}
+
+	// There was no default binding for this sequence to begin with.
+	l.UnregisterKeybinding(keys)
+}
+
+type VTState int
+
+const (
+	VTStateFree VTState = iota
+	VTStateEscape
+	VTStateBracket
+	VTStateBracketArgsSemi
+	VTStateTitle
+	VTStateTitleEscape
+)
+
+func (l *lineEditor) ActualRenderedStringMetrics(line string) StringMetrics {
+	return l.actualRenderedStringMetricsImpl(line, []maskEntry{})
+}
+
+// measuredLine is the line actualRenderedStringMetricsImpl is measuring, along with the column drawing it has got to,
+// which a carriage return moves back.
+type measuredLine struct {
+	LineMetrics
+	column uint32
+}
+
+func (l *lineEditor) actualRenderedStringMetricsImpl(line string, masks []maskEntry) StringMetrics {
+	metrics := StringMetrics{}
+	currentLine := measuredLine{}
+	state := VTStateFree
+	runes := []rune(line)
+	byteOffset := 0
+	var mask *Mask
+	maskIt := 0
+
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if maskIt < len(masks) && masks[maskIt].start <= uint32(i) {
+			mask = masks[maskIt].mask
+		}
+
+		if mask != nil && mask.mode == MaskModeReplaceEntireSelection {
+			maskIt++
+			actualEndOffset := uint32(len(runes))
+			if maskIt < len(masks) {
+				actualEndOffset = masks[maskIt].start
+			}
+			endOffset := min(actualEndOffset, uint32(len(runes)))
 			j := 0
 			for it := 0; it != len(mask.replacementView); it++ {
 				itCopy := it
@@ -798,7 +1530,9 @@ func (l *lineEditor) actualRenderedStringMetricsImpl(line string, masks []maskEn
 				}
 				state = l.actualRenderedStringLengthStep(&metrics, j, &currentLine, mask.replacementView[it], nextC, state, nil)
 				j++
-				if uint32(j) <= actualEndOffset-uint32(i) && j+i >= len(runes) {
+				// Only a span cut short by the end of line is cut short on screen too,
+				// one that ends right where the line does is drawn in full.
+				if actualEndOffset > uint32(len(runes)) && j+i >= len(runes) {
 					break
 				}
 			}
@@ -831,7 +1565,7 @@ func (l *lineEditor) actualRenderedStringMetricsImpl(line string, masks []maskEn
 		}
 	}
 
-	metrics.LineMetrics = append(metrics.LineMetrics, currentLine)
+	metrics.LineMetrics = append(metrics.LineMetrics, currentLine.LineMetrics)
 	for _, lineMetric := range metrics.LineMetrics {
 		metrics.MaxLineLength = max(lineMetric.TotalLength(), metrics.MaxLineLength)
 	}
@@ -843,10 +1577,145 @@ func (l *lineEditor) SetTabCompletionHandler(handler TabCompletionHandler) {
 	l.tabCompletionHandler = handler
 }
 
+func (l *lineEditor) SetContextTabCompletionHandler(handler ContextTabCompletionHandler) {
+	if handler == nil {
+		l.tabCompletionHandler = nil
+		return
+	}
+	l.tabCompletionHandler = func(editor Editor) []Completion {
+		return handler(l.completionContext(), editor)
+	}
+}
+
+func (l *lineEditor) SetTokenizer(tokenizer Tokenizer) {
+	l.tokenizer = tokenizer
+}
+
+// fillCompletionOffsets gives completions without offsets the ones for the token being completed, see SetTokenizer.
+func (l *lineEditor) fillCompletionOffsets(completions []Completion) {
+	_, start, _ := l.TokenAtCursor()
+	if start >= l.cursor {
+		return
+	}
+
+	// What's typed may be quoted or escaped, completions are of what it stands for.
+	typed := string(l.buffer[start:l.cursor])
+	var unescaped string
+	if tokens, _ := l.tokenizer(typed, l.cursor-start); len(tokens) != 0 {
+		unescaped = tokens[0].Text
+	}
+	for i := range completions {
+		completion := &completions[i]
+		if completion.InvariantOffset != 0 || completion.StaticOffset != 0 {
+			continue
+		}
+		quoted := l.quoteLike(completion.Text, typed)
+		if strings.HasPrefix(completion.Text, unescaped) && strings.HasPrefix(quoted, typed) {
+			completion.InvariantOffset = l.cursor - start
+		} else {
+			completion.StaticOffset = l.cursor - start
+		}
+		completion.Text = quoted
+	}
+}
+
+// quoteLike quotes text the way typed is, for it to be read back as a single token: within the same quotes if
+// typed starts with one, and with a backslash before anything the tokenizer wouldn't keep in a token otherwise.
+func (l *lineEditor) quoteLike(text, typed string) string {
+	if tokens, _ := l.tokenizer(`\ `, 0); len(tokens) != 1 || tokens[0].Text != " " {
+		// Nothing can be escaped (or, most likely, quoted) for this tokenizer.
+		return text
+	}
+	if strings.HasPrefix(typed, "'") {
+		return "'" + strings.ReplaceAll(text, "'", `'\''`) + "'"
+	}
+
+	var quoted strings.Builder
+	quote := strings.HasPrefix(typed, `"`)
+	if quote {
+		quoted.WriteByte('"')
+	}
+	for _, c := range text {
+		if c == '\\' || c == '"' || !quote && !l.keepsInToken(c) {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	if quote {
+		quoted.WriteByte('"')
+	}
+	return quoted.String()
+}
+
+// keepsInToken returns whether c on its own is read as a token of just c, rather than splitting tokens or quoting.
+func (l *lineEditor) keepsInToken(c rune) bool {
+	tokens, _ := l.tokenizer(string(c), 0)
+	return len(tokens) == 1 && tokens[0].Text == string(c)
+}
+
+func (l *lineEditor) completionContext() CompletionContext {
+	token, start, end := l.TokenAtCursor()
+	return CompletionContext{
+		Line:       string(l.buffer),
+		Cursor:     l.cursor,
+		Token:      token,
+		Prefix:     string(l.buffer[start:l.cursor]),
+		TokenStart: start,
+		TokenEnd:   end,
+	}
+}
+
+// WordAtCursor returns the alphanumeric word the cursor is in (or right after), and its bounds in code points.
+// If there is no such word, the returned text is empty and both bounds are at the cursor.
+func (l *lineEditor) WordAtCursor() (string, uint32, uint32) {
+	start := l.cursor
+	for start > 0 && isAlphaNumeric(l.buffer[start-1]) {
+		start--
+	}
+	end := l.cursor
+	for end < uint32(len(l.buffer)) && isAlphaNumeric(l.buffer[end]) {
+		end++
+	}
+	return string(l.buffer[start:end]), start, end
+}
+
+// TokenAtCursor returns the token the cursor is in (or right after), and its bounds in code points.
+// Tokens are delimited by whitespace, unless a tokenizer says otherwise.
+func (l *lineEditor) TokenAtCursor() (string, uint32, uint32) {
+	if l.tokenizer != nil {
+		tokens, current := l.tokenizer(string(l.buffer), l.cursor)
+		if current < 0 || current >= len(tokens) {
+			return "", l.cursor, l.cursor
+		}
+		return tokens[current].Text, tokens[current].Start, tokens[current].End
+	}
+
+	start := l.cursor
+	for start > 0 && !isSpace(l.buffer[start-1]) {
+		start--
+	}
+	end := l.cursor
+	for end < uint32(len(l.buffer)) && !isSpace(l.buffer[end]) {
+		end++
+	}
+	return string(l.buffer[start:end]), start, end
+}
+
 func (l *lineEditor) SetPasteHandler(handler PasteHandler) {
 	l.pasteHandler = handler
 }
 
+// SetPasteDetectionThreshold makes the editor treat at least this many bytes of input arriving all at once
+// as a paste, on terminals without bracketed paste. 0 (the default) turns paste detection off.
+func (l *lineEditor) SetPasteDetectionThreshold(threshold int) {
+	l.pasteDetectionThreshold = threshold
+}
+
+// SetMaxPasteSize cuts pastes longer than size code points short, ringing the bell. 0 (the default) means no limit.
+func (l *lineEditor) SetMaxPasteSize(size int) {
+	l.maxPasteSize = size
+}
+
 func (l *lineEditor) SetInterruptHandler(handler func()) {
 	l.onInterruptHandled = handler
 }
@@ -855,13 +1724,286 @@ func (l *lineEditor) SetRefreshHandler(handler func(editor Editor)) {
 	l.onRefresh = handler
 }
 
+func (l *lineEditor) SetResizeHandler(handler func(newSize Winsize)) {
+	l.onResize = handler
+}
+
+func (l *lineEditor) SetBufferChangedHandler(handler func(editor Editor)) {
+	l.onBufferChanged = handler
+}
+
+func (l *lineEditor) SetTrimTrailingWhitespaceOnSubmit(trim bool) {
+	l.trimTrailingWhitespaceOnSubmit = trim
+}
+
+func (l *lineEditor) SetNormalization(form Normalization) {
+	l.normalization = form
+}
+
+func (l *lineEditor) SetKeepEditingAfterInterrupt(keep bool) {
+	l.keepEditingAfterInterrupt = keep
+}
+
+// SetEchoCtrlCOnInterrupt sets whether "^C" is written out when the line is interrupted, which it is by default.
+func (l *lineEditor) SetEchoCtrlCOnInterrupt(echo bool) {
+	l.echoCtrlCOnInterrupt = echo
+}
+
+// SetCtrlCIsInterrupt decides whether ^C interrupts the editor, or is just another key that can be bound.
+// Turning it off also keeps the terminal from sending SIGINT for it, the terminal is put back as it was on restore.
+func (l *lineEditor) SetCtrlCIsInterrupt(interrupt bool) {
+	l.ctrlCIsInterrupt = interrupt
+	if !l.initialized {
+		return
+	}
+
+	l.termios = l.rawTermios()
+	_ = setTermios(&l.termios)
+}
+
+// SetRawModeFlags picks which of the terminal's modes are turned off while editing, see RawModeFlags.
+// The terminal is put back as it was on restore either way.
+func (l *lineEditor) SetRawModeFlags(flags RawModeFlags) {
+	l.rawModeFlags = flags
+	if !l.initialized {
+		return
+	}
+
+	l.termios = l.rawTermios()
+	_ = setTermios(&l.termios)
+}
+
+// SetBracketedPasteEnabled turns bracketed paste on or off, right away if a line is being edited.
+func (l *lineEditor) SetBracketedPasteEnabled(enabled bool) {
+	if l.enableBracketedPaste == enabled {
+		return
+	}
+
+	l.enableBracketedPaste = enabled
+	if !l.isEditing || !l.initialized {
+		// The terminal isn't ours (GetLine isn't running, or SuspendAndRun lent it out), whoever has it
+		// now wouldn't know what to do with the paste markers; GetLine turns it on when it starts.
+		return
+	}
+
+	if enabled {
+		_, _ = os.Stderr.Write([]byte("\x1b[?2004h"))
+	} else {
+		_, _ = os.Stderr.Write([]byte("\x1b[?2004l"))
+	}
+}
+
+// SetFocusReportingEnabled turns the terminal's focus reporting on or off, right away if a line is being edited.
+// The focus handler hears of the terminal gaining and losing focus while it's on.
+func (l *lineEditor) SetFocusReportingEnabled(enabled bool) {
+	if l.enableFocusReporting == enabled {
+		return
+	}
+
+	l.enableFocusReporting = enabled
+	if !l.isEditing || !l.initialized {
+		// Like bracketed paste, the focus events would only end up in the input of whoever has the terminal now.
+		return
+	}
+	if enabled {
+		_, _ = os.Stderr.Write([]byte("\x1b[?1004h"))
+	} else {
+		_, _ = os.Stderr.Write([]byte("\x1b[?1004l"))
+	}
+}
+
+func (l *lineEditor) SetFocusHandler(handler func(focused bool)) {
+	l.focusHandler = handler
+}
+
+// rawTermios derives the terminal modes to edit with from the ones the terminal was in to begin with.
+func (l *lineEditor) rawTermios() unix.Termios {
+	t := l.defaultTermios
+	flags := l.rawModeFlags
+	if !l.ctrlCIsInterrupt {
+		flags |= RawModeSignals
+	}
+
+	if flags&RawModeEcho != 0 {
+		t.Lflag &^= unix.ECHO
+	}
+	if flags&RawModeCanonical != 0 {
+		t.Lflag &^= unix.ICANON
+	}
+	if flags&RawModeSignals != 0 {
+		t.Lflag &^= unix.ISIG
+	}
+	if flags&RawModeFlowControl != 0 {
+		t.Iflag &^= unix.IXON
+	}
+	if flags&RawModeCRToNL != 0 {
+		t.Iflag &^= unix.ICRNL
+	}
+	if flags&RawModeOutputProcessing != 0 {
+		t.Oflag &^= unix.OPOST
+	}
+	return t
+}
+
+func (l *lineEditor) SetReturnLineOnInterrupt(keep bool) {
+	l.returnLineOnInterrupt = keep
+}
+
+func (l *lineEditor) SetInputStyle(style Style) {
+	// Masks and hyperlinks only make sense on spans.
+	style.Mask = nil
+	style.Hyperlink = ""
+	l.inputStyle = style
+	l.refreshNeeded = true
+}
+
+func (l *lineEditor) SetMultilineMode(enabled bool) {
+	l.multilineMode = enabled
+}
+
+// SetBleedStyleToEndOfLine has the style in effect at the end of the buffer fill the rest of its line
+// (e.g. to highlight a whole line with a background colour), instead of stopping where the text does.
+func (l *lineEditor) SetBleedStyleToEndOfLine(bleed bool) {
+	l.bleedStyleToEndOfLine = bleed
+	l.refreshNeeded = true
+}
+
+// SetRevealMasks draws the buffer as it is, ignoring masks (e.g. to show a password), until called again with false.
+// The masks stay in place either way.
+func (l *lineEditor) SetRevealMasks(reveal bool) {
+	if l.revealMasks == reveal {
+		return
+	}
+	l.revealMasks = reveal
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
+}
+
+func (l *lineEditor) RevealMasks() bool {
+	return l.revealMasks
+}
+
+func (l *lineEditor) SetWrapIndent(indent uint32) {
+	l.wrapIndent = indent
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
+}
+
+func (l *lineEditor) SetPlaceholder(text string, style Style) {
+	if style.IsEmpty() {
+		style = Style{ForegroundColor: Color{R: 128, G: 128, B: 128, HasValue: true}}
+	}
+	l.placeholder = []rune(text)
+	l.placeholderStyle = style
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
+}
+
+func (l *lineEditor) SetHintHandler(handler func(line string, cursor uint32) string) {
+	l.hintHandler = handler
+	l.refreshNeeded = true
+}
+
+func (l *lineEditor) SetLineWrapMode(mode LineWrapMode) {
+	l.lineWrapMode = mode
+	l.refreshNeeded = true
+}
+
+func (l *lineEditor) SetControlCharRenderer(renderer ControlCharRenderer) {
+	l.controlCharRenderer = renderer
+	l.cachedPromptValid = false
+	l.refreshNeeded = true
+}
+
+func (l *lineEditor) SetBeepOnAmbiguousCompletion(beep bool) {
+	l.suggestionManager.setBeepOnAmbiguousCompletion(beep)
+}
+
+func (l *lineEditor) SetAutoCommitSingleCompletion(autoCommit bool) {
+	l.suggestionManager.setConfirmSingleSuggestion(!autoCommit)
+}
+
+func (l *lineEditor) SetCompletionAppendSpace(appendTrivia bool) {
+	l.suggestionManager.setOmitTrailingTrivia(!appendTrivia)
+}
+
+func (l *lineEditor) SetCompletionSort(less func(a, b Completion) bool) {
+	l.suggestionManager.setSort(less)
+}
+
+func (l *lineEditor) SetMaxSuggestionLines(lines uint32) {
+	l.suggestionDisplay.setMaxLines(lines)
+}
+
+// SetMinCompletionPrefix keeps tab from asking for completions until the token before the cursor
+// is at least length code points long, so short tokens don't bring up a flood of suggestions.
+func (l *lineEditor) SetMinCompletionPrefix(length uint32) {
+	l.minCompletionPrefix = length
+}
+
+func (l *lineEditor) SetTitle(title string) {
+	l.title = title
+	vtSetTitle(title, os.Stderr)
+}
+
+func (l *lineEditor) SetTitleCallback(callback func(editor Editor) string) {
+	l.titleCallback = callback
+}
+
+func (l *lineEditor) SetAlwaysRefresh(always bool) {
+	l.alwaysRefresh = always
+	l.refreshNeeded = true
+}
+
+func (l *lineEditor) AlwaysRefresh() bool {
+	return l.alwaysRefresh
+}
+
+func (l *lineEditor) SetInputLogger(logger InputLogger) {
+	l.inputLogger = logger
+}
+
+func (l *lineEditor) SetCompletionQuickSelect(enabled bool) {
+	l.suggestionDisplay.setQuickSelect(enabled)
+}
+
 func (l *lineEditor) SetLine(line string) {
-	l.inlineSearchCursor = min(l.cursor, uint32(len(line)))
-	l.cursor = l.inlineSearchCursor
+	runes := []rune(line)
+	if l.inRefreshHandler {
+		// Refresh handlers tend to rewrite the line on every keystroke,
+		// don't let that disturb an ongoing completion or history search.
+		if string(l.buffer) == line {
+			return
+		}
+		l.inlineSearchCursor = min(l.inlineSearchCursor, uint32(len(runes)))
+		l.cursor = min(l.cursor, uint32(len(runes)))
+	} else {
+		l.inlineSearchCursor = min(l.cursor, uint32(len(runes)))
+		l.cursor = l.inlineSearchCursor
+	}
 	l.charsTouchedInTheMiddle = uint32(len(l.buffer))
 	l.refreshNeeded = true
-	l.buffer = []rune(line)
+	l.markBufferChanged()
+	l.buffer = runes
+	// The metrics are replaced before the new line is drawn, so remember how many lines the old one freed up.
+	shownLines := l.NumLines()
 	l.cachedBufferMetrics = l.ActualRenderedStringMetrics(line)
+	if newLines := l.NumLines(); newLines < shownLines {
+		l.extraForwardLines = max(shownLines-newLines, l.extraForwardLines)
+	}
+}
+
+// ClearLine empties the buffer, leaving the prompt, its position and the history alone.
+func (l *lineEditor) ClearLine() {
+	l.unstylizeSuggestion()
+	l.hasMark = false
+	l.hasSelection = false
+	l.charsTouchedInTheMiddle = uint32(len(l.buffer))
+	l.markBufferChanged()
+	l.buffer = l.buffer[:0]
+	l.cursor = 0
+	l.inlineSearchCursor = 0
+	l.refreshNeeded = true
 }
 
 func (l *lineEditor) Line() string {
@@ -872,7 +2014,71 @@ func (l *lineEditor) LineUpTo(n uint32) string {
 	return string(l.buffer[:n])
 }
 
+// RenderStyled returns the buffer as it's drawn, with the escape sequences for its styles and with
+// masks applied, optionally after the prompt. Nothing about the terminal (wrapping, scrolling) is
+// taken into account.
+func (l *lineEditor) RenderStyled(includePrompt bool) string {
+	outputBuffer := bytes.NewBuffer(nil)
+	if includePrompt {
+		outputBuffer.WriteString(l.basePrompt)
+	}
+	if !l.inputStyle.IsEmpty() {
+		vtApplyStyle(l.baseStyle(), outputBuffer, true)
+	}
+	for i := range l.buffer {
+		l.applyStylesAt(uint32(i), outputBuffer)
+		l.printCharacterAt(uint32(i), outputBuffer, nil)
+	}
+	vtApplyStyle(StyleReset, outputBuffer, true)
+	return outputBuffer.String()
+}
+
+func (l *lineEditor) SetPromptEscapesEnabled(enabled bool) {
+	l.expandPromptEscapes = enabled
+}
+
 func (l *lineEditor) SetPrompt(prompt string) {
+	if l.expandPromptEscapes {
+		// This has to happen before measuring, the expansions change the prompt's width.
+		prompt = expandPromptEscapes(prompt)
+	}
+	l.basePrompt = prompt
+	l.updatePrompt()
+}
+
+// PushPrompt switches to prompt until the matching PopPrompt, e.g. for a question asked in the middle of editing.
+func (l *lineEditor) PushPrompt(prompt string) {
+	l.promptStack = append(l.promptStack, l.basePrompt)
+	l.SetPrompt(prompt)
+	l.refreshNeeded = true
+}
+
+// PopPrompt goes back to the prompt that was there before the last PushPrompt, if any.
+func (l *lineEditor) PopPrompt() {
+	if len(l.promptStack) == 0 {
+		return
+	}
+
+	l.basePrompt = l.promptStack[len(l.promptStack)-1]
+	l.promptStack = l.promptStack[:len(l.promptStack)-1]
+	l.updatePrompt()
+	l.refreshNeeded = true
+}
+
+// SetHeader shows lines between the prompt and the buffer, they're redrawn along with the prompt.
+func (l *lineEditor) SetHeader(lines []string) {
+	l.header = append([]string{}, lines...)
+	l.updatePrompt()
+	l.refreshNeeded = true
+}
+
+// updatePrompt puts the header below the prompt, as far as drawing and measuring goes they're one and the same.
+func (l *lineEditor) updatePrompt() {
+	prompt := l.basePrompt
+	if len(l.header) > 0 {
+		// Clear the rest of each line, so a shorter header doesn't leave parts of the previous one behind.
+		prompt += "\x1b[K\n" + strings.Join(l.header, "\x1b[K\n") + "\x1b[K\n"
+	}
 	if l.cachedPromptValid {
 		l.oldPromptMetrics = l.cachedPromptMetrics
 	}
@@ -882,45 +2088,66 @@ func (l *lineEditor) SetPrompt(prompt string) {
 }
 
 func (l *lineEditor) InsertString(str string) {
-	runes := []rune(str)
-	for _, r := range runes {
-		l.InsertChar(r)
-	}
+	l.insertRunes([]rune(str))
 }
 
 func (l *lineEditor) InsertChar(ch rune) {
-	s := string(ch)
-	l.pendingChars = append(l.pendingChars, s...)
+	l.insertRunes([]rune{ch})
+}
+
+// insertRunes puts runes in the buffer at the cursor, all in one go, and moves the cursor past them.
+func (l *lineEditor) insertRunes(runes []rune) {
+	if len(runes) == 0 {
+		return
+	}
+
+	for i, ch := range runes {
+		if !utf8.ValidRune(ch) {
+			// Surrogates and out of range values have no UTF-8 encoding, and so no byte length to do offset math with.
+			runes[i] = utf8.RuneError
+		}
+	}
+
+	l.markBufferChanged()
+	count := uint32(len(runes))
+	if l.hasMark && l.cursor < l.mark {
+		l.mark += count
+	}
+	if l.hasSelection && l.cursor < l.selectionAnchor {
+		l.selectionAnchor += count
+	}
+	l.adjustSuggestionStyle(l.cursor, count, true)
+	l.pendingChars = append(l.pendingChars, string(runes)...)
 
 	if l.cursor == uint32(len(l.buffer)) {
-		l.buffer = append(l.buffer, ch)
+		l.buffer = append(l.buffer, runes...)
 		l.cursor = uint32(len(l.buffer))
 		l.inlineSearchCursor = l.cursor
 		return
 	}
 
-	b := append([]rune{}, l.buffer[:l.cursor]...)
-	b = append(b, ch)
+	b := make([]rune, 0, len(l.buffer)+len(runes))
+	b = append(b, l.buffer[:l.cursor]...)
+	b = append(b, runes...)
 	l.buffer = append(b, l.buffer[l.cursor:]...)
 	l.charsTouchedInTheMiddle++
-	l.cursor++
+	l.cursor += count
 	l.inlineSearchCursor = l.cursor
 }
 
-type sortableMaskEntrySlice struct {
-	entries []maskEntry
-}
-
-func (s *sortableMaskEntrySlice) Len() int {
-	return len(s.entries)
-}
-
-func (s *sortableMaskEntrySlice) Less(i, j int) bool {
-	return s.entries[i].start < s.entries[j].start
-}
-
-func (s *sortableMaskEntrySlice) Swap(i, j int) {
-	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+// compactMaskEntries drops mask entries that don't change the active mask,
+// i.e. "no mask" markers that follow another "no mask" marker (or nothing at all).
+func compactMaskEntries(entries []maskEntry) []maskEntry {
+	result := entries[:0]
+	var previous *Mask
+	for _, e := range entries {
+		if e.mask == nil && previous == nil {
+			continue
+		}
+		result = append(result, e)
+		previous = e.mask
+	}
+	return result
 }
 
 func (l *lineEditor) Stylize(span Span, style Style) {
@@ -942,43 +2169,30 @@ func (l *lineEditor) Stylize(span Span, style Style) {
 	mask := style.Mask
 
 	if mask != nil {
-		i := len(l.currentMasks)
-		for j := len(l.currentMasks); j > 0; j-- {
-			e := l.currentMasks[j-1]
-			if e.start < start {
+		// Whatever mask was in effect at the end of the new span continues after it.
+		var maskAtEnd *Mask
+		for _, e := range l.currentMasks {
+			if e.start > end {
 				break
 			}
-			i = j - 1
-		}
-		var lastEncounteredEntry *Mask
-		if i != len(l.currentMasks) {
-			// Delete all overlapping old masks
-			for {
-				nextI := len(l.currentMasks)
-				for j, e := range l.currentMasks {
-					if e.start > start {
-						break
-					}
-					nextI = j
-				}
-				if nextI == len(l.currentMasks) {
-					break
-				}
-				entry := &l.currentMasks[nextI]
-				if entry.mask != nil {
-					lastEncounteredEntry = entry.mask
-				}
-				l.currentMasks = append(l.currentMasks[:nextI], l.currentMasks[nextI+1:]...)
+			maskAtEnd = e.mask
+		}
+
+		// Replace every entry inside [start, end] with the new span, this keeps
+		// restyling the same spans on every refresh from growing the list.
+		masks := make([]maskEntry, 0, len(l.currentMasks)+2)
+		for _, e := range l.currentMasks {
+			if e.start < start {
+				masks = append(masks, e)
 			}
 		}
-		l.currentMasks = append(l.currentMasks, []maskEntry{{start, mask}, {end, nil}}...)
-		if lastEncounteredEntry != nil {
-			l.currentMasks = append(l.currentMasks, maskEntry{end + 1, lastEncounteredEntry})
+		masks = append(masks, maskEntry{start, mask}, maskEntry{end, maskAtEnd})
+		for _, e := range l.currentMasks {
+			if e.start > end {
+				masks = append(masks, e)
+			}
 		}
-
-		sortable := &sortableMaskEntrySlice{l.currentMasks}
-		sort.Sort(sortable)
-		l.currentMasks = sortable.entries
+		l.currentMasks = compactMaskEntries(masks)
 		style.Mask = nil
 	}
 
@@ -1018,6 +2232,8 @@ func (l *lineEditor) Stylize(span Span, style Style) {
 
 func (l *lineEditor) StripStyles() {
 	l.currentSpans = spans{}
+	l.hasSuggestionStyle = false
+	l.hasDrawnSelection = false
 	l.currentMasks = l.currentMasks[:0]
 	l.refreshNeeded = true
 }
@@ -1051,6 +2267,11 @@ func (l *lineEditor) IsEditing() bool {
 	return l.isEditing
 }
 
+// LastError returns the error the last GetLine returned with (nil if none), until the next one starts.
+func (l *lineEditor) LastError() error {
+	return l.inputError
+}
+
 func (l *lineEditor) Reset() {
 	l.cachedBufferMetrics.Reset()
 	l.cachedPromptValid = false
@@ -1059,6 +2280,7 @@ func (l *lineEditor) Reset() {
 	l.inlineSearchCursor = 0
 	l.searchOffset = 0
 	l.searchOffsetState = searchOffsetStateUnbiased
+	l.hasHistoryStash = false
 	l.oldPromptMetrics = l.cachedPromptMetrics
 	l.setOriginValue(0, 0)
 	l.promptLinesAtSuggestionInitiation = 0
@@ -1069,25 +2291,44 @@ func (l *lineEditor) Reset() {
 	l.drawnEndOfLineOffset = 0
 	l.drawnSpans = spans{}
 	l.pasteBuffer = []rune{}
+	l.hasMark = false
+	l.hasSuggestionStyle = false
+	l.hasSelection = false
+	l.hasDrawnSelection = false
+	l.bufferDirty = false
+	l.bufferChanged = false
 }
 
+// recalculateOrigin works out where the prompt starts from where the terminal reported the cursor to be after a
+// resize. Nothing has been redrawn for the new width yet, so the cursor is still as many lines below the start of
+// the prompt as it was drawn at with the old one.
 func (l *lineEditor) recalculateOrigin() {
-	// Changing the columns can affect our origin if
-	// the new size is smaller than our prompt, which would
-	// cause said prompt to take up more space, so we should
-	// compensate for that.
-	if l.cachedPromptMetrics.MaxLineLength >= l.numColumns {
-		l.originRow += (l.cachedPromptMetrics.MaxLineLength+1)/l.numColumns - 1
+	var cursorLine uint32
+	l.withColumns(l.previousNumColumns, func() {
+		cursorLine = l.cursorLine() - 1
+	})
+	if l.originRow > cursorLine {
+		l.setOriginValue(l.originRow-cursorLine, 1)
+	} else {
+		l.setOriginValue(1, 1)
 	}
+}
 
-	// We also need to recalculate our cursor position,
-	// but that will be calculated and applied at the next
-	// refresh cycle.
+// withColumns runs f with the metrics worked out for a terminal columns wide, e.g. for what was drawn before a resize.
+func (l *lineEditor) withColumns(columns uint32, f func()) {
+	current := l.numColumns
+	l.numColumns = columns
+	defer func() {
+		l.numColumns = current
+	}()
+	f()
 }
 
 func (l *lineEditor) cleanup() {
-	currentBufferMetrics := l.actualRenderedStringMetricsImpl(string(l.buffer), l.currentMasks)
-	newLines := l.CurrentPromptMetrics().LinesWithAddition(&currentBufferMetrics, l.numColumns)
+	// Whatever lines were drawn last time but won't be anymore have to go, that's however many
+	// lines were freed by deleting newlines (or wrapped lines) and by a shorter prompt.
+	currentBufferMetrics := l.bufferMetrics(uint32(len(l.buffer)))
+	newLines := l.cachedPromptMetrics.linesWithAddition(&currentBufferMetrics, l.numColumns, l.wrapIndent)
 	shownLines := l.NumLines()
 	if newLines < shownLines {
 		l.extraForwardLines = max(shownLines-newLines, l.extraForwardLines)
@@ -1101,28 +2342,74 @@ func (l *lineEditor) cleanup() {
 }
 
 func (l *lineEditor) NumLines() uint32 {
-	return l.CurrentPromptMetrics().LinesWithAddition(&l.cachedBufferMetrics, l.numColumns)
+	return l.CurrentPromptMetrics().linesWithAddition(&l.cachedBufferMetrics, l.numColumns, l.wrapIndent)
+}
+
+func (l *lineEditor) PromptEndPosition() (row, col uint32) {
+	line, offset := l.lineAndOffsetOf(0)
+	return line - 1, offset
 }
 
 func (l *lineEditor) refreshDisplay() {
+	if l.isRefreshing {
+		// A handler called from here wants another refresh; the one in progress hasn't decided
+		// what to draw yet, so have it draw everything rather than starting over halfway through it.
+		l.refreshNeeded = true
+		return
+	}
+	l.isRefreshing = true
+
 	outputBuffer := bytes.NewBuffer(nil)
 	defer func() {
+		l.drawHint(outputBuffer)
 		_, _ = os.Stderr.Write(outputBuffer.Bytes())
+		l.isRefreshing = false
 	}()
 
+	if l.bufferChanged {
+		if l.onBufferChanged != nil {
+			l.onBufferChanged(l)
+		}
+		// Whatever the handler itself changed doesn't count, or it'd be called forever.
+		l.bufferChanged = false
+	}
+
+	if l.titleCallback != nil {
+		if title := l.titleCallback(l); title != l.title {
+			l.title = title
+			vtSetTitle(title, outputBuffer)
+		}
+	}
+
+	l.updateSelectionStyle()
+
+	if l.hasDrawnPlaceholder && len(l.buffer) != 0 {
+		// Whatever is typed only covers part of the placeholder, draw everything over it.
+		l.refreshNeeded = true
+		l.charsTouchedInTheMiddle++
+	}
+
+	if l.updateScroll() || l.isScrolling && len(l.pendingChars) != 0 {
+		// Whatever is visible may have moved sideways, redraw all of it.
+		l.refreshNeeded = true
+		l.charsTouchedInTheMiddle++
+	}
+
 	hasCleanedUp := false
 	if l.wasResized {
 		if l.previousNumColumns != l.numColumns {
+			// Clear every line of what was drawn with the old width, and nothing past it, whatever came before
+			// the prompt stays put.
 			l.cachedPromptValid = false
 			l.refreshNeeded = true
-			t := l.numColumns
-			l.numColumns = l.previousNumColumns
-			l.previousNumColumns = t
-			l.recalculateOrigin()
-			l.cleanup()
-			t = l.numColumns
-			l.numColumns = l.previousNumColumns
-			l.previousNumColumns = t
+			var shownLines uint32
+			l.withColumns(l.previousNumColumns, func() {
+				shownLines = l.NumLines()
+			})
+			vtMoveAbsolute(l.originRow, 1, outputBuffer)
+			vtClearLines(1, shownLines-1, outputBuffer)
+			l.extraForwardLines = 0
+			l.previousNumColumns = l.numColumns
 			hasCleanedUp = true
 		}
 		l.wasResized = false
@@ -1132,177 +2419,152 @@ func (l *lineEditor) refreshDisplay() {
 	// Refreshing the display will cause the terminal to scroll,
 	// so note that fact and bring origin up, making sure to
 	// reserve the space for however many lines we move it up.
-	currentNumLines := l.NumLines()
+	// Use the buffer as it is now, the cached metrics are from before whatever was just typed,
+	// and that may be exactly what pushes the line past the edge of the terminal.
+	// Likewise the prompt as it is about to be drawn, not the one on screen.
+	bufferMetrics := l.bufferMetrics(uint32(len(l.buffer)))
+	currentNumLines := l.cachedPromptMetrics.linesWithAddition(&bufferMetrics, l.numColumns, l.wrapIndent)
 	if l.originRow+currentNumLines > l.numLines {
+		oldOriginRow := l.originRow
 		if currentNumLines > l.numLines {
 			for i := uint32(0); i < l.numLines; i++ {
 				_, _ = outputBuffer.WriteString("\n")
 			}
 			l.originRow = 0
 		} else {
-			oldOriginRow := l.originRow
+			// Scroll rather than write newlines, the cursor isn't necessarily on the last row.
 			l.originRow = l.numLines - currentNumLines + 1
-			for i := uint32(0); i < oldOriginRow-l.originRow; i++ {
-				_, _ = outputBuffer.WriteString("\n")
+			if oldOriginRow > l.originRow {
+				fmt.Fprintf(outputBuffer, "\x1b[%dS", oldOriginRow-l.originRow)
 			}
 		}
+		if l.originRow != oldOriginRow {
+			// Everything moved up, so none of it can just be added to where it was drawn.
+			l.refreshNeeded = true
+			l.charsTouchedInTheMiddle++
+		}
 	}
 
 	// Do not call hook on pure cursor movement.
 	if l.cachedPromptValid && !l.refreshNeeded && len(l.pendingChars) == 0 {
 		// Probably just moving around
 		l.repositionCursor(outputBuffer, false)
-		l.cachedBufferMetrics = l.actualRenderedStringMetricsImpl(string(l.buffer), l.currentMasks)
+		l.cachedBufferMetrics = l.bufferMetrics(uint32(len(l.buffer)))
 		l.drawnEndOfLineOffset = uint32(len(l.buffer))
 		return
 	}
 
 	if l.onRefresh != nil {
+		l.inRefreshHandler = true
 		l.onRefresh(l)
+		l.inRefreshHandler = false
 	}
 
 	if l.cachedPromptValid {
-		if !l.refreshNeeded && l.cursor == uint32(len(l.buffer)) {
+		if !l.refreshNeeded && !l.bleedStyleToEndOfLine && l.wrapIndent == 0 && l.cursor == uint32(len(l.buffer)) && pendingCharsDrawVerbatim(l.pendingChars) {
 			// Just write the characters out and continue,
 			// no need to refresh the entire line
+			if !l.inputStyle.IsEmpty() {
+				vtApplyStyle(l.baseStyle(), outputBuffer, true)
+			}
 			outputBuffer.Write(l.pendingChars)
+			if !l.inputStyle.IsEmpty() {
+				vtApplyStyle(StyleReset, outputBuffer, true)
+			}
 			l.pendingChars = []byte{}
 			l.drawnCursor = l.cursor
 			l.drawnEndOfLineOffset = uint32(len(l.buffer))
-			l.cachedBufferMetrics = l.actualRenderedStringMetricsImpl(string(l.buffer), l.currentMasks)
+			l.cachedBufferMetrics = l.bufferMetrics(uint32(len(l.buffer)))
 			l.drawnSpans = l.currentSpans
 			return
 		}
 	}
 
-	applyStyles := func(i uint32) {
-		ends := l.currentSpans.spansEnding[i]
-		starts := l.currentSpans.spansStarting[i]
-
-		if len(ends) > 0 {
-			style := Style{}
-			for _, applicableStyle := range ends {
-				style.UnifyWith(applicableStyle)
-			}
-
-			vtApplyStyle(style, outputBuffer, false)
-			style = l.findApplicableStyle(i)
-			vtApplyStyle(style, outputBuffer, true)
-		}
-		if len(starts) > 0 {
-			style := Style{}
-			for _, applicableStyle := range starts {
-				style.UnifyWith(applicableStyle)
-			}
-
-			vtApplyStyle(style, outputBuffer, true)
-		}
-	}
-
-	printCharacterAt := func(i uint32) {
-		var c interface{}
-		it := len(l.currentMasks)
-		for j, e := range l.currentMasks {
-			if e.start > i {
-				break
-			}
-			it = j
-		}
-		if it < len(l.currentMasks) && l.currentMasks[it].mask != nil {
-			offset := i - l.currentMasks[it].start
-			mask := l.currentMasks[it].mask
-			if mask.mode == MaskModeReplaceEntireSelection {
-				v := mask.replacementView
-				if offset >= uint32(len(v)) {
-					return
-				}
-				c = v[offset]
-				it++
-				nextOffset := l.drawnEndOfLineOffset
-				if it < len(l.currentMasks) {
-					nextOffset = l.currentMasks[it].start
-				}
-				if i+1 == nextOffset {
-					c = v[offset : len(v)-1]
-				}
-			} else {
-				c = mask.replacementView
-			}
-		} else {
-			c = l.buffer[i]
-		}
-		printSingleCharacter := func(c rune) {
-			shouldPrintMasked := c == 0x7f || c < 0x20 && c != '\n'
-			shouldPrintCaret := c < 64 && shouldPrintMasked
-			s := ""
-			if shouldPrintCaret {
-				s = "^" + string(c+64)
-			} else if shouldPrintMasked {
-				s = "\\x" + strconv.FormatInt(int64(c), 16)
-			} else {
-				s = string(c)
-			}
-
-			if shouldPrintMasked {
-				outputBuffer.WriteString("\x1b[7m")
-			}
-			outputBuffer.WriteString(s)
-			if shouldPrintMasked {
-				outputBuffer.WriteString("\x1b[27m")
-			}
-		}
-
-		switch c.(type) {
-		case rune:
-			printSingleCharacter(c.(rune))
-		case []rune:
-			for _, r := range c.([]rune) {
-				printSingleCharacter(r)
-			}
-		}
-	}
+	// The column the next character is drawn at, only tracked to indent wrapped rows.
+	wrapColumn := uint32(0)
 
-	if !l.alwaysRefresh && l.cachedPromptValid && l.charsTouchedInTheMiddle == 0 && l.drawnSpans.containsUpToOffset(&l.currentSpans, l.drawnCursor) {
+	if !l.alwaysRefresh && l.wrapIndent == 0 && l.cachedPromptValid && l.charsTouchedInTheMiddle == 0 && l.drawnSpans.containsUpToOffset(&l.currentSpans, l.drawnCursor) {
 		initialStyle := l.findApplicableStyle(l.drawnEndOfLineOffset)
 		vtApplyStyle(initialStyle, outputBuffer, true)
 
 		for i := l.drawnEndOfLineOffset; i < uint32(len(l.buffer)); i++ {
-			applyStyles(i)
-			printCharacterAt(i)
+			l.applyStylesAt(i, outputBuffer)
+			l.printCharacterAt(i, outputBuffer, &wrapColumn)
 		}
 
+		if l.bleedStyleToEndOfLine {
+			l.fillToEndOfLine(outputBuffer)
+		}
 		vtApplyStyle(StyleReset, outputBuffer, true)
 		l.pendingChars = []byte{}
 		l.refreshNeeded = false
-		l.cachedBufferMetrics = l.actualRenderedStringMetricsImpl(string(l.buffer), l.currentMasks)
+		l.cachedBufferMetrics = l.bufferMetrics(uint32(len(l.buffer)))
 		l.charsTouchedInTheMiddle = 0
 		l.drawnCursor = l.cursor
 		l.drawnEndOfLineOffset = uint32(len(l.buffer))
 
-		// No need to reposition the cursor, it's already in the right place
+		if l.bleedStyleToEndOfLine {
+			l.repositionCursor(outputBuffer, false)
+		}
+		// Otherwise, no need to reposition the cursor, it's already in the right place
 		return
 	}
 
 	// Ouch, reflow entire line
 	if !hasCleanedUp {
+		// That goes straight to the terminal, after whatever was put together so far, e.g. the scrolling above.
+		_, _ = os.Stderr.Write(outputBuffer.Bytes())
+		outputBuffer.Reset()
 		l.cleanup()
 	}
 
 	vtMoveAbsolute(l.originRow, l.originColumn, outputBuffer)
 	outputBuffer.WriteString(l.newPrompt)
 
+	if promptMetrics := l.cachedPromptMetrics.LineMetrics; len(promptMetrics) > 0 && l.numColumns > 0 {
+		if length := promptMetrics[len(promptMetrics)-1].TotalLength(); length > 0 && length%l.numColumns == 0 {
+			// The prompt fills its last row, and the cursor is still on it, waiting to wrap; clearing from
+			// there would take the last character of the prompt with it.
+			outputBuffer.WriteString("\r\n")
+		}
+	}
 	vtClearToEndOfLine(outputBuffer)
 
-	for i := uint32(0); i < uint32(len(l.buffer)); i++ {
-		applyStyles(i)
-		printCharacterAt(i)
+	if !l.inputStyle.IsEmpty() {
+		vtApplyStyle(l.baseStyle(), outputBuffer, true)
+	}
+
+	start, end := uint32(0), uint32(len(l.buffer))
+	if l.isScrolling {
+		start, end = l.scrollStart, l.scrollEnd
+		if start > 0 {
+			outputBuffer.WriteString("…")
+		}
+		vtApplyStyle(l.findApplicableStyle(start), outputBuffer, true)
+	}
+
+	if promptMetrics := l.cachedPromptMetrics.LineMetrics; len(promptMetrics) > 0 && l.numColumns > 0 {
+		wrapColumn = promptMetrics[len(promptMetrics)-1].TotalLength() % l.numColumns
 	}
+	for i := start; i < end; i++ {
+		l.applyStylesAt(i, outputBuffer)
+		l.printCharacterAt(i, outputBuffer, &wrapColumn)
+	}
+
+	l.hasDrawnPlaceholder = len(l.buffer) == 0 && l.drawPlaceholder(outputBuffer)
+
+	if l.bleedStyleToEndOfLine && end == uint32(len(l.buffer)) && !l.hasDrawnPlaceholder {
+		l.fillToEndOfLine(outputBuffer)
+	}
+	vtApplyStyle(StyleReset, outputBuffer, true) // Don't bleed to EOL (any further)
 
-	vtApplyStyle(StyleReset, outputBuffer, true) // Don't bleed to EOL
+	if end < uint32(len(l.buffer)) {
+		outputBuffer.WriteString("…")
+	}
 
 	l.pendingChars = []byte{}
 	l.refreshNeeded = false
-	l.cachedBufferMetrics = l.actualRenderedStringMetricsImpl(string(l.buffer), l.currentMasks)
+	l.cachedBufferMetrics = l.bufferMetrics(uint32(len(l.buffer)))
 	l.charsTouchedInTheMiddle = 0
 	l.drawnSpans = l.currentSpans
 	l.drawnEndOfLineOffset = uint32(len(l.buffer))
@@ -1311,8 +2573,214 @@ func (l *lineEditor) refreshDisplay() {
 	l.repositionCursor(outputBuffer, false)
 }
 
-func (l *lineEditor) findApplicableStyle(offset uint32) Style {
+// applyStylesAt writes out the style changes that happen right before the code point at i.
+func (l *lineEditor) applyStylesAt(i uint32, outputBuffer *bytes.Buffer) {
+	ends := l.currentSpans.spansEnding[i]
+	starts := l.currentSpans.spansStarting[i]
+
+	if len(ends) > 0 {
+		style := Style{}
+		for _, applicableStyle := range ends {
+			style.UnifyWith(applicableStyle)
+		}
+
+		vtApplyStyle(style, outputBuffer, false)
+		style = l.findApplicableStyle(i)
+		vtApplyStyle(style, outputBuffer, true)
+	}
+	if len(starts) > 0 {
+		style := Style{}
+		for _, applicableStyle := range starts {
+			style.UnifyWith(applicableStyle)
+		}
+
+		vtApplyStyle(style, outputBuffer, true)
+	}
+}
+
+// printCharacterAt writes out the code point at i, or whatever a mask has it show instead.
+// wrapColumn is the column it goes at, if the wrapping is to be done here to indent wrapped rows.
+func (l *lineEditor) printCharacterAt(i uint32, outputBuffer *bytes.Buffer, wrapColumn *uint32) {
+	var c interface{}
+	masks := l.visibleMasks()
+	it := len(masks)
+	for j, e := range masks {
+		if e.start > i {
+			break
+		}
+		it = j
+	}
+	if it < len(masks) && masks[it].mask != nil {
+		offset := i - masks[it].start
+		mask := masks[it].mask
+		if mask.mode == MaskModeReplaceEntireSelection {
+			v := mask.replacementView
+			if offset >= uint32(len(v)) {
+				return
+			}
+			c = v[offset]
+			it++
+			nextOffset := uint32(len(l.buffer))
+			if it < len(masks) {
+				nextOffset = masks[it].start
+			}
+			if i+1 == nextOffset {
+				// The last code point of the span gets whatever is left of the replacement.
+				c = v[offset:]
+			}
+		} else {
+			c = mask.replacementView
+		}
+	} else {
+		c = l.buffer[i]
+	}
+	printSingleCharacter := func(c rune) {
+		shouldPrintMasked := c == 0x7f || c < 0x20 && c != '\n'
+		s := string(c)
+		width := runeWidth(c)
+		if shouldPrintMasked {
+			s, width = l.renderControlCharacter(c)
+			// Custom renderers are in charge of their own styling.
+			shouldPrintMasked = l.controlCharRenderer == nil
+		}
+
+		if wrapColumn != nil && l.wrapIndent > 0 && l.wrapIndent < l.numColumns && !l.isScrolling {
+			// Do the terminal's wrapping for it, so the next row can be indented.
+			if c == '\n' {
+				*wrapColumn = 0
+			} else {
+				if *wrapColumn > 0 && *wrapColumn+width > l.numColumns {
+					outputBuffer.WriteString("\r\n")
+					outputBuffer.WriteString(strings.Repeat(" ", int(l.wrapIndent)))
+					*wrapColumn = l.wrapIndent
+				}
+				*wrapColumn += width
+			}
+		}
+
+		if shouldPrintMasked {
+			outputBuffer.WriteString("\x1b[7m")
+		}
+		outputBuffer.WriteString(s)
+		if shouldPrintMasked {
+			outputBuffer.WriteString("\x1b[27m")
+		}
+	}
+
+	switch c.(type) {
+	case rune:
+		printSingleCharacter(c.(rune))
+	case []rune:
+		for _, r := range c.([]rune) {
+			printSingleCharacter(r)
+		}
+	}
+}
+
+// drawPlaceholder writes out as much of the placeholder as fits on the rest of the prompt's last line,
+// the cursor is put back where the buffer starts afterwards.
+func (l *lineEditor) drawPlaceholder(w io.Writer) bool {
+	_, column := l.lineAndOffsetOf(0)
+	available := int64(l.numColumns) - int64(column) - int64(max(l.originColumn, 1))
+	width := int64(0)
+	end := 0
+	for ; end < len(l.placeholder); end++ {
+		width += int64(runeWidth(l.placeholder[end]))
+		if width > available {
+			break
+		}
+	}
+	if end == 0 {
+		return false
+	}
+
+	vtApplyStyle(l.placeholderStyle, w, true)
+	_, _ = w.Write([]byte(string(l.placeholder[:end])))
+	vtApplyStyle(StyleReset, w, true)
+	return true
+}
+
+// drawHint draws the hint on the row below the buffer, or clears away the one drawn before if there's none now.
+// The suggestions and the search prompt go in the same place, so there's no hint while either is shown.
+func (l *lineEditor) drawHint(w *bytes.Buffer) {
+	if l.hintHandler == nil && !l.hasDrawnHint || l.isSearching || l.IsShowingCompletions() {
+		return
+	}
+
+	hintString := ""
+	if l.hintHandler != nil && !l.finish {
+		hintString = l.hintHandler(string(l.buffer), l.cursor)
+	}
+	if index := strings.IndexByte(hintString, '\n'); index != -1 {
+		hintString = hintString[:index]
+	}
+	hint := []rune(hintString)
+	if len(hint) == 0 && !l.hasDrawnHint {
+		return
+	}
+
+	l.repositionCursor(w, true)
+	lastRow := l.originRow + l.NumLines() - 1
+	if len(hint) == 0 {
+		if lastRow < l.numLines {
+			_, _ = w.WriteString("\r\n")
+			vtClearToEndOfScreen(w)
+		}
+		l.hasDrawnHint = false
+		l.repositionCursor(w, false)
+		return
+	}
+
+	_, _ = w.WriteString("\r\n")
+	if lastRow >= l.numLines && l.originRow > 1 {
+		// That scrolled the terminal.
+		l.originRow--
+	}
+	vtClearToEndOfScreen(w)
+
+	// Stop short of the last column, so the terminal doesn't wrap.
+	width := uint32(0)
+	end := 0
+	for ; end < len(hint); end++ {
+		width += runeWidth(hint[end])
+		if width+1 > l.numColumns {
+			break
+		}
+	}
+	_, _ = w.WriteString("\x1b[2m" + string(hint[:end]) + "\x1b[22m")
+	l.hasDrawnHint = true
+	l.repositionCursor(w, false)
+}
+
+// fillToEndOfLine carries the style in effect at the end of the buffer on to the right margin.
+func (l *lineEditor) fillToEndOfLine(w io.Writer) {
+	_, column := l.lineAndOffsetOf(uint32(len(l.buffer)))
+	// Stop short of the last column, writing there could have the terminal wrap;
+	// clearing the rest of the line fills it with the background colour instead.
+	if spaces := int64(l.numColumns) - int64(column) - int64(max(l.originColumn, 1)); spaces > 0 {
+		_, _ = w.Write(bytes.Repeat([]byte{' '}, int(spaces)))
+	}
+	vtClearToEndOfLine(w)
+}
+
+// baseStyle is the style every character in the buffer starts out with,
+// before any span is applied on top of it.
+func (l *lineEditor) baseStyle() Style {
 	style := StyleReset
+	if l.inputStyle.ForegroundColor.HasValue {
+		style.ForegroundColor = l.inputStyle.ForegroundColor
+	}
+	if l.inputStyle.BackgroundColor.HasValue {
+		style.BackgroundColor = l.inputStyle.BackgroundColor
+	}
+	style.Bold = l.inputStyle.Bold
+	style.Italic = l.inputStyle.Italic
+	style.Underline = l.inputStyle.Underline
+	return style
+}
+
+func (l *lineEditor) findApplicableStyle(offset uint32) Style {
+	style := l.baseStyle()
 	unify := func(key uint32, value map[uint32]Style) {
 		if key >= offset {
 			return
@@ -1334,24 +2802,23 @@ func (l *lineEditor) findApplicableStyle(offset uint32) Style {
 	return style
 }
 
-func (l *lineEditor) actualRenderedStringLengthStep(metrics *StringMetrics, index int, currentLine *LineMetrics, c, nextC rune, state VTState, mask *Mask) VTState {
+func (l *lineEditor) actualRenderedStringLengthStep(metrics *StringMetrics, index int, currentLine *measuredLine, c, nextC rune, state VTState, mask *Mask) VTState {
 	switch state {
 	case VTStateFree:
 		if c == '\x1b' {
 			return VTStateEscape
 		}
 		if c == '\r' {
-			currentLine.MaskedChars = []MaskedChar{}
-			currentLine.Length = 0
-			if len(metrics.LineMetrics) != 0 {
-				metrics.LineMetrics[len(metrics.LineMetrics)-1] = LineMetrics{}
-			}
+			// Carriage return only moves the column back, anything drawn
+			// past the new column stays on screen until overwritten.
+			currentLine.column = 0
 			return state
 		}
 		if c == '\n' {
-			metrics.LineMetrics = append(metrics.LineMetrics, *currentLine)
+			metrics.LineMetrics = append(metrics.LineMetrics, currentLine.LineMetrics)
 			currentLine.MaskedChars = []MaskedChar{}
 			currentLine.Length = 0
+			currentLine.column = 0
 			return state
 		}
 		maskedLength := 0
@@ -1365,10 +2832,8 @@ func (l *lineEditor) actualRenderedStringLengthStep(metrics *StringMetrics, inde
 					MaskedLength:   uint32(len(mask.replacementView)),
 				})
 			} else {
-				maskedLength = 2
-				if c > 64 {
-					maskedLength = 4
-				}
+				_, width := l.renderControlCharacter(c)
+				maskedLength = int(width)
 				currentLine.MaskedChars = append(currentLine.MaskedChars, MaskedChar{
 					Position:       uint32(index),
 					OriginalLength: 1,
@@ -1376,52 +2841,118 @@ func (l *lineEditor) actualRenderedStringLengthStep(metrics *StringMetrics, inde
 				})
 			}
 		}
+		width := runeWidth(c)
 		if mask != nil {
-			currentLine.Length += uint32(len(mask.replacementView))
-			metrics.TotalLength += uint32(len(mask.replacementView))
+			width = uint32(len(mask.replacementView))
 		} else if isControl {
-			currentLine.Length += uint32(maskedLength)
-			metrics.TotalLength += uint32(maskedLength)
-		} else {
-			currentLine.Length++
-			metrics.TotalLength++
+			width = uint32(maskedLength)
 		}
+		currentLine.column += width
+		currentLine.Length = max(currentLine.Length, currentLine.column)
+		metrics.TotalLength += width
 		return state
 	case VTStateEscape:
 		if c == ']' {
-			if nextC == '0' {
-				return VTStateTitle
-			}
-			return state
+			// Any OSC (title, hyperlink, colors...), none of which take up space.
+			return VTStateTitle
 		}
 		if c == '[' {
 			return VTStateBracket
 		}
-		return state
-	case VTStateBracket:
-		if c >= '0' && c <= '9' {
-			return VTStateBracketArgsSemi
-		}
-		return state
-	case VTStateBracketArgsSemi:
-		if c == ';' {
-			return VTStateBracket
-		}
-		if c >= '0' && c <= '9' {
+		if c >= 0x20 && c <= 0x2f { // Intermediate bytes, e.g. ^[(B
 			return state
 		}
-
+		return VTStateFree
+	case VTStateBracket, VTStateBracketArgsSemi:
+		// CSI: parameter bytes '0'-'?', then intermediate bytes ' '-'/', then a single final byte.
+		if c >= 0x20 && c <= 0x3f {
+			return VTStateBracketArgsSemi
+		}
 		return VTStateFree
 	case VTStateTitle:
-		if c == 7 {
+		// OSC sequences end with either BEL or ST (^[\\ or its C1 form).
+		if c == 7 || c == 0x9c {
 			return VTStateFree
 		}
+		if c == '\x1b' {
+			return VTStateTitleEscape
+		}
 		return state
+	case VTStateTitleEscape:
+		if c == '\\' {
+			return VTStateFree
+		}
+		// Any other escape cuts the OSC short and starts a new sequence.
+		return l.actualRenderedStringLengthStep(metrics, index, currentLine, c, nextC, VTStateEscape, mask)
 	default:
 		return state
 	}
 }
 
+// wideRanges are the (inclusive) ranges of code points terminals draw two columns wide,
+// the East Asian Wide and Fullwidth blocks plus the emoji blocks.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f},
+	{0x231a, 0x231b},
+	{0x2329, 0x232a},
+	{0x2e80, 0x303e},
+	{0x3041, 0x33ff},
+	{0x3400, 0x4dbf},
+	{0x4e00, 0x9fff},
+	{0xa000, 0xa4cf},
+	{0xa960, 0xa97f},
+	{0xac00, 0xd7a3},
+	{0xf900, 0xfaff},
+	{0xfe10, 0xfe19},
+	{0xfe30, 0xfe6f},
+	{0xff00, 0xff60},
+	{0xffe0, 0xffe6},
+	{0x1f300, 0x1f64f},
+	{0x1f900, 0x1f9ff},
+	{0x20000, 0x2fffd},
+	{0x30000, 0x3fffd},
+}
+
+// runeWidth returns how many columns a printable code point takes up on the terminal.
+func runeWidth(c rune) uint32 {
+	if c == 0x200b || c == 0x200d || unicode.In(c, unicode.Mn, unicode.Me) {
+		// Zero-width spaces and joiners, and combining marks draw over the previous character.
+		return 0
+	}
+	for _, r := range wideRanges {
+		if c < r[0] {
+			break
+		}
+		if c <= r[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+// pendingCharsDrawVerbatim returns whether the pending characters look the same written straight to the terminal
+// as they would when drawn by a full refresh, i.e. there's nothing the terminal would interpret in there.
+func pendingCharsDrawVerbatim(pending []byte) bool {
+	for _, c := range string(pending) {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// renderControlCharacter returns how a control character is displayed, and how wide that display is.
+func (l *lineEditor) renderControlCharacter(c rune) (string, uint32) {
+	if l.controlCharRenderer != nil {
+		return l.controlCharRenderer(c)
+	}
+	if c < 64 {
+		return "^" + string(c+64), 2
+	}
+	s := "\\x" + strconv.FormatInt(int64(c), 16)
+	return s, uint32(len(s))
+}
+
 func (l *lineEditor) byteOffsetRangeToCodePointOffsetRange(startByteOffset, endByteOffset, scanCodePointOffset uint32, reverse bool) (start, end uint32) {
 	byteOffset := uint32(0)
 	codePointOffset := scanCodePointOffset
@@ -1539,6 +3070,10 @@ func vtClearToEndOfLine(w io.Writer) {
 	_, _ = w.Write([]byte("\x1b[K"))
 }
 
+func vtClearToEndOfScreen(w io.Writer) {
+	_, _ = w.Write([]byte("\x1b[J"))
+}
+
 func vtMoveAbsolute(row, col uint32, w io.Writer) {
 	_, _ = fmt.Fprintf(w, "\x1b[%d;%dH", row, col)
 }
@@ -1551,6 +3086,17 @@ func vtRestoreCursor(w io.Writer) {
 	_, _ = w.Write([]byte("\x1b[u"))
 }
 
+func vtSetTitle(title string, w io.Writer) {
+	// Control characters would end the sequence early (or start another one), so leave them out.
+	title = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, title)
+	_, _ = fmt.Fprintf(w, "\x1b]0;%s\x07", title)
+}
+
 func (s *spans) containsUpToOffset(other *spans, offset uint32) bool {
 	compare := func(left, right *map[uint32]map[uint32]Style) bool {
 		for entryKey, entryValue := range *right {
@@ -1610,16 +3156,35 @@ func (l *lineEditor) tryUpdateOnce() {
 }
 
 func (l *lineEditor) reallyQuitEventLoop() {
-	l.repositionCursor(os.Stderr, true)
-	os.Stderr.WriteString("\r\n")
+	// What's left on screen is what gets returned, so settle any completion that's in progress,
+	// and don't leave a selection highlighted behind.
+	l.CommitPendingCompletion()
+	l.hasSelection = false
+	l.refreshDisplay()
+
+	// Whatever the caller writes next goes below the line and unstyled, and the terminal is back
+	// to how it was (bracketed paste and all) by the time GetLine returns.
+	outputBuffer := bytes.NewBuffer(nil)
+	l.repositionCursor(outputBuffer, true)
+	vtApplyStyle(StyleReset, outputBuffer, true)
+	outputBuffer.WriteString("\r\n")
+	_, _ = os.Stderr.Write(outputBuffer.Bytes())
+	// That's where the next line starts unless something else is written first, which is as good a guess
+	// as any should the terminal not tell us then.
+	l.setOriginValue(min(l.originRow+l.NumLines(), max(l.numLines, 1)), 1)
 
 	str := l.Line()
+	if l.trimTrailingWhitespaceOnSubmit {
+		str = strings.TrimRightFunc(str, isSpace)
+	}
+	str = normalize(str, l.normalization)
 	l.buffer = []rune{}
 	l.charsTouchedInTheMiddle = 0
 
 	if l.initialized {
 		l.restore()
 	}
+	l.isEditing = false
 
 	l.returnedLine = str
 
@@ -1627,9 +3192,151 @@ func (l *lineEditor) reallyQuitEventLoop() {
 
 }
 
+// normalize returns line in the given normalization form.
+func normalize(line string, form Normalization) string {
+	switch form {
+	case NormNFC:
+		return norm.NFC.String(line)
+	case NormNFD:
+		return norm.NFD.String(line)
+	}
+	return line
+}
+
 var csiParameterBytes []byte
 var csiIntermediateBytes []byte
 
+// handleDeleteKey erases forwards for Delete, or backwards for Backspace, as sent with modifiers by terminals.
+// The encodings we know of are:
+//
+//	^[[3~       Delete                          a character forwards
+//	^[[3;2~     Shift-Delete                    a character forwards
+//	^[[3;3~     Alt-Delete                      a word forwards
+//	^[[3;5~     Ctrl-Delete                     a word forwards
+//	^[[3^       Ctrl-Delete (rxvt)              a word forwards
+//	^[[127;3u   Alt-Backspace (CSI u)           a word backwards
+//	^[[127;5u   Ctrl-Backspace (CSI u)          a word backwards
+//	^[[8;5u     Ctrl-Backspace as ^H (CSI u)    a word backwards
+//
+// Plain Backspace (^? or ^H) and Alt-Backspace (^[^? or ^[^H) arrive as keys and go through the key bindings,
+// note that xterm-likes send a bare ^H for Ctrl-Backspace, which can't be told apart from Backspace.
+func (l *lineEditor) handleDeleteKey(backwards bool, modifiers uint32) {
+	word := modifiers&(ModifierCtrl|ModifierAlt) != 0
+	switch {
+	case l.DeleteSelection():
+	case backwards && word:
+		eraseAlnumWordBackwards(l)
+	case backwards:
+		eraseCharacterBackwards(l)
+	case word:
+		eraseAlnumWordForwards(l)
+	default:
+		eraseCharacterForwards(l)
+	}
+	l.searchOffset = 0
+	l.hasHistoryStash = false
+}
+
+// pasteContinuationWindow is how soon after a detected paste more input has to come in to be taken as part of it.
+const pasteContinuationWindow = 20 * time.Millisecond
+
+// handleDetectedPaste treats the pending input as pasted if there's more of it than anyone could type at once,
+// for terminals that don't do (or weren't asked for) bracketed paste. Pasted text is inserted as-is,
+// instead of having every character go through the keybindings.
+func (l *lineEditor) handleDetectedPaste(continued bool) bool {
+	if !continued && len(l.incompleteData) < l.pasteDetectionThreshold {
+		return false
+	}
+	if l.enableBracketedPaste && bytes.Contains(l.incompleteData, []byte("\x1b[200~")) {
+		// The terminal marked the paste itself.
+		return false
+	}
+
+	// Escape sequences aren't text, whatever starts at one (a key pressed right after the paste, say) goes through
+	// the usual input handling; and leave a partial code point at the end for the next read to complete.
+	end := len(l.incompleteData)
+	if escape := bytes.IndexByte(l.incompleteData, 0x1b); escape >= 0 {
+		end = escape
+	}
+	for end > 0 && !utf8.Valid(l.incompleteData[:end]) {
+		end--
+	}
+	if end == 0 {
+		return false
+	}
+	text := string(l.incompleteData[:end])
+	l.incompleteData = append(l.incompleteData[:0], l.incompleteData[end:]...)
+	if l.inputLogger != nil {
+		l.inputLogger([]byte(text), "paste")
+	}
+
+	if !continued {
+		l.startPaste()
+	}
+	text = string(l.limitPaste([]rune(text)))
+
+	l.cleanupSuggestions()
+	if l.pasteHandler != nil {
+		l.pasteHandler(text, l)
+	} else {
+		l.InsertString(text)
+	}
+	l.lastDetectedPaste = time.Now()
+	return true
+}
+
+func (l *lineEditor) startPaste() {
+	l.pastedLength = 0
+	l.pasteTruncated = false
+}
+
+// limitPaste cuts text, the next part of the paste in progress, short to what's left of the paste size limit.
+// The bell rings the first time a paste is cut short.
+func (l *lineEditor) limitPaste(text []rune) []rune {
+	if l.maxPasteSize <= 0 {
+		return text
+	}
+
+	left := l.maxPasteSize - l.pastedLength
+	if left < len(text) {
+		if !l.pasteTruncated {
+			l.ringBell()
+		}
+		l.pasteTruncated = true
+		if left < 0 {
+			left = 0
+		}
+		text = text[:left]
+	}
+	l.pastedLength += len(text)
+	return text
+}
+
+// describeKey returns a human-readable name for a single key, control characters are shown in caret notation.
+func describeKey(codePoint rune) string {
+	switch {
+	case codePoint == 0x7f:
+		return "^?"
+	case codePoint < 0x20:
+		return "^" + string(codePoint+0x40)
+	default:
+		return string(codePoint)
+	}
+}
+
+// isSS3Final returns whether c ends one of the ^[O sequences terminals send for keys (cursor and keypad keys, F1-F4).
+func isSS3Final(c rune) bool {
+	return strings.ContainsRune("ABCDFHMPQRSX", c) || c >= 'j' && c <= 'y'
+}
+
+// ignoreInput drops a sequence the editor has no use for; writing anything about it out would only end up in
+// the middle of the line, so only the input logger hears of it.
+func (l *lineEditor) ignoreInput(sequence string, reason string) {
+	if l.inputLogger != nil {
+		l.inputLogger([]byte(sequence), reason+", ignored")
+	}
+}
+
 func (l *lineEditor) handleReadEvent() {
 	if l.prohibitInputProcessing {
 		l.haveUnprocessedReadEvent = true
@@ -1645,14 +3352,14 @@ func (l *lineEditor) handleReadEvent() {
 	var nread int
 	var err error
 
-	for utf8.RuneCount(l.incompleteData) == 0 {
+	for !utf8.FullRune(l.incompleteData) {
 		nread, err = unix.Read(unix.Stdin, keyBuf)
 		if err == nil && nread == 0 {
 			break
 		}
 
 		// FIXME: Somehow this sneaks in here when the user presses Ctrl-C
-		if nread == 1 && keyBuf[0] == byte(ctrl('C')) {
+		if nread == 1 && keyBuf[0] == byte(ctrl('C')) && l.ctrlCIsInterrupt {
 			l.handleInterruptEvent()
 			break
 		}
@@ -1679,6 +3386,23 @@ func (l *lineEditor) handleReadEvent() {
 		}
 
 		l.incompleteData = append(l.incompleteData, keyBuf[:nread]...)
+		if l.inputLogger != nil {
+			l.inputLogger(keyBuf[:nread], "read")
+		}
+	}
+
+	if l.pasteDetectionThreshold > 0 && nread > 0 && l.state == inputStateFree {
+		// A read of at least the threshold is a paste, and a full one means there's likely more where that came
+		// from, see whether it's a paste. Whatever comes in right after a paste is the rest of it that didn't make
+		// it in time, and must not go through the keybindings (or start completing on a tab) any more than the
+		// rest did.
+		continued := time.Since(l.lastDetectedPaste) < pasteContinuationWindow
+		if nread >= l.pasteDetectionThreshold || nread == len(keyBuf) || continued {
+			l.readPendingInput()
+			if l.handleDetectedPaste(continued) && len(l.incompleteData) == 0 {
+				return
+			}
+		}
 	}
 
 	availableBytes := len(l.incompleteData)
@@ -1701,21 +3425,59 @@ func (l *lineEditor) handleReadEvent() {
 		availableBytes--
 	}
 
-	inputView := []rune(string(l.incompleteData))
+	// Decode what's there, leaving a code point that's been cut short for the next read to complete.
+	// The bytes each code point came from are kept, as invalid ones are one byte each but decode to U+FFFD.
+	var inputView []rune
+	var inputSizes []int
+	for data := l.incompleteData; utf8.FullRune(data); {
+		codePoint, size := utf8.DecodeRune(data)
+		inputView = append(inputView, codePoint)
+		inputSizes = append(inputSizes, size)
+		data = data[size:]
+	}
 	consumedCodePoints := 0
+	consumedBytes := 0
 
 	csiParameters := make([]uint32, 0, 4)
 	csiFinal := byte(0)
 
+	skipCodePoints := 0
+
 	for _, codePoint := range inputView {
 		if func() iterationDecision {
 			if l.finish {
 				return iterationDecisionBreak
 			}
 
-			consumedCodePoints++
+			index := consumedCodePoints
+			consumedCodePoints++
+			consumedBytes += inputSizes[index]
+
+			if skipCodePoints > 0 {
+				// Part of a raw sequence that was already handled.
+				skipCodePoints--
+				return iterationDecisionContinue
+			}
+
+			if l.state == inputStateFree && len(l.rawSequences) > 0 {
+				if l.continuesRawSequence(inputView[index:]) && l.waitForInput(rawSequenceTimeout) {
+					// More of what may well be a (longer) raw sequence came in, take it all from the top.
+					consumedCodePoints--
+					consumedBytes -= inputSizes[index]
+					return iterationDecisionBreak
+				}
+				if binding := l.findRawSequence(inputView[index:]); binding != nil {
+					skipCodePoints = len(binding.sequence) - 1
+					if l.inputLogger != nil {
+						l.inputLogger([]byte(string(binding.sequence)), "raw sequence")
+					}
+					binding.callback([]byte(string(binding.sequence)), l)
+					return iterationDecisionContinue
+				}
+			}
 
-			if codePoint == 0 {
+			// NUL is only meaningful as a key (^@/^Space), never inside a sequence.
+			if codePoint == 0 && l.state != inputStateFree {
 				return iterationDecisionContinue
 			}
 
@@ -1725,8 +3487,19 @@ func (l *lineEditor) handleReadEvent() {
 				case '[':
 					l.state = inputStateCSIExpectParameter
 					return iterationDecisionContinue
+				case 'O':
+					// Terminals send the keys that go ^[O<final> all at once, Alt-O followed by
+					// a key typed after it comes in separately (or is followed by something else).
+					if consumedCodePoints < len(inputView) && isSS3Final(inputView[consumedCodePoints]) {
+						l.state = inputStateSS3
+						return iterationDecisionContinue
+					}
+					fallthrough
 				default:
-					l.keyCallbackMachine.keyPressed(key{
+					if l.inputLogger != nil {
+						l.inputLogger([]byte(string([]rune{'\x1b', codePoint})), "Alt-"+describeKey(codePoint))
+					}
+					l.keyCallbackMachine.keyPressed(KeyPress{
 						modifiers: ModifierAlt,
 						key:       uint32(codePoint),
 					}, l)
@@ -1769,25 +3542,31 @@ func (l *lineEditor) handleReadEvent() {
 					modifiers = 0
 				}
 
+				parameterBytes, intermediateBytes := string(csiParameterBytes), string(csiIntermediateBytes)
+				sequence := "\x1b[" + parameterBytes + intermediateBytes + string(codePoint)
+				csiParameters = csiParameters[:0]
+				csiParameterBytes = csiParameterBytes[:0]
+				csiIntermediateBytes = csiIntermediateBytes[:0]
+
 				if isInPaste && codePoint != '~' && param1 != 201 {
 					// The only valid escape to process in paste mode is the stop-paste sequence.
 					// so treat everything else as part of the pasted data.
 					l.InsertChar('\x1b')
 					l.InsertChar('[')
-					l.InsertString(string(csiParameterBytes))
-					l.InsertString(string(csiIntermediateBytes))
+					l.InsertString(parameterBytes)
+					l.InsertString(intermediateBytes)
 					l.InsertChar(codePoint)
 					return iterationDecisionContinue
 				}
 				if !(codePoint >= 0x40 && codePoint <= 0x7f) {
-					fmt.Fprintf(os.Stderr, "Invalid CSI: %02x (%c)\n", codePoint, codePoint)
+					l.ignoreInput(sequence, fmt.Sprintf("invalid CSI final %02x", codePoint))
 					return iterationDecisionContinue
 				}
 
 				csiFinal = byte(codePoint)
-				csiParameters = csiParameters[:0]
-				csiParameterBytes = csiParameterBytes[:0]
-				csiIntermediateBytes = csiIntermediateBytes[:0]
+				if l.inputLogger != nil {
+					l.inputLogger([]byte(sequence), fmt.Sprintf("CSI %q %q %c", parameterBytes, intermediateBytes, csiFinal))
+				}
 
 				if csiFinal == 'Z' {
 					// "reverse tab"
@@ -1795,43 +3574,72 @@ func (l *lineEditor) handleReadEvent() {
 					break
 				}
 
+				if csiFinal == 'R' && strings.Count(parameterBytes, ";") == 1 && param1 > 0 && param2 > 0 {
+					// ^[[<row>;<column>R: A cursor position report that came too late for vtDSR.
+					l.ignoreInput(sequence, "late cursor position report")
+					return iterationDecisionContinue
+				}
+
+				if csiFinal == 'I' || csiFinal == 'O' {
+					// ^[[I, ^[[O: Focus in and out, with focus reporting on
+					if l.focusHandler != nil {
+						l.focusHandler(csiFinal == 'I')
+					}
+					return iterationDecisionContinue
+				}
+
 				l.cleanupSuggestions()
 
+				if strings.IndexByte("ABCDHF", csiFinal) != -1 {
+					// Shift+movement extends the selection, any other movement drops it.
+					l.extendSelection(modifiers&ModifierShift != 0 && csiFinal != 'A' && csiFinal != 'B')
+					modifiers &^= ModifierShift
+				}
+
 				switch csiFinal {
 				case 'A': // ^[[A: Arrow up
-					searchBackwards(l)
+					cursorUpLineOrSearchBackwards(l)
 					return iterationDecisionContinue
 				case 'B': // ^[[B: Arrow down
-					searchForwards(l)
+					cursorDownLineOrSearchForwards(l)
 					return iterationDecisionContinue
-				case 'D': // ^[[D: Arrow left
+				case 'D': // ^[[D: Arrow left, ^[[1;2D: Shift-Arrow left
 					if modifiers == ModifierAlt || modifiers == ModifierCtrl {
 						cursorLeftWord(l)
 					} else {
 						cursorLeftCharacter(l)
 					}
 					return iterationDecisionContinue
-				case 'C': // ^[[C: Arrow right
+				case 'C': // ^[[C: Arrow right, ^[[1;2C: Shift-Arrow right
 					if modifiers == ModifierAlt || modifiers == ModifierCtrl {
 						cursorRightWord(l)
 					} else {
 						cursorRightCharacter(l)
 					}
 					return iterationDecisionContinue
-				case 'H': // ^[[H: Home
+				case 'H': // ^[[H: Home, ^[[1;2H: Shift-Home
 					goHome(l)
 					return iterationDecisionContinue
-				case 'F': // ^[[F: End
+				case 'F': // ^[[F: End, ^[[1;2F: Shift-End
 					goEnd(l)
 					return iterationDecisionContinue
+				case '^':
+					if param1 == 3 { // ^[[3^: Ctrl-Delete (rxvt)
+						l.handleDeleteKey(false, ModifierCtrl)
+						return iterationDecisionContinue
+					}
+					l.ignoreInput(sequence, "unknown CSI ^")
+					return iterationDecisionContinue
+				case 'u':
+					if param1 == 127 || param1 == 8 { // ^[[127;Nu: Backspace with modifiers (CSI u)
+						l.handleDeleteKey(true, modifiers)
+						return iterationDecisionContinue
+					}
+					l.ignoreInput(sequence, "unknown CSI u")
+					return iterationDecisionContinue
 				case '~':
-					if param1 == 3 { // ^[[3~: Delete
-						if modifiers == ModifierCtrl {
-							eraseAlnumWordForwards(l)
-						} else {
-							eraseCharacterForwards(l)
-						}
-						l.searchOffset = 0
+					if param1 == 3 { // ^[[3;N~: Delete
+						l.handleDeleteKey(false, modifiers)
 						return iterationDecisionContinue
 					}
 					if l.enableBracketedPaste {
@@ -1839,6 +3647,7 @@ func (l *lineEditor) handleReadEvent() {
 						// ^[[201~: Stop paste mode
 						if !isInPaste && param1 == 200 {
 							l.state = inputStatePaste
+							l.startPaste()
 							return iterationDecisionContinue
 						}
 						if isInPaste && param1 == 201 {
@@ -1852,15 +3661,61 @@ func (l *lineEditor) handleReadEvent() {
 							}
 							return iterationDecisionContinue
 						}
-						fmt.Fprintf(os.Stderr, "Unknown '~': %d\n", param1)
-						return iterationDecisionContinue
 					}
+					l.ignoreInput(sequence, "unknown CSI ~")
+					return iterationDecisionContinue
 				default:
-					fmt.Fprintf(os.Stderr, "Unknown Final: %02x (%c)\n", csiFinal, csiFinal)
+					l.ignoreInput(sequence, "unknown CSI final")
+					return iterationDecisionContinue
+				}
+			case inputStateSS3:
+				l.state = l.previousFreeState
+				if l.state == inputStatePaste {
+					l.InsertChar('\x1b')
+					l.InsertChar('O')
+					l.InsertChar(codePoint)
 					return iterationDecisionContinue
 				}
 
-				panic("unreachable")
+				if l.inputLogger != nil {
+					l.inputLogger([]byte(string([]rune{'\x1b', 'O', codePoint})), fmt.Sprintf("SS3 %c", codePoint))
+				}
+
+				l.cleanupSuggestions()
+
+				switch codePoint {
+				case 'A': // ^[OA: Arrow up (application cursor mode)
+					cursorUpLineOrSearchBackwards(l)
+					return iterationDecisionContinue
+				case 'B': // ^[OB: Arrow down
+					cursorDownLineOrSearchForwards(l)
+					return iterationDecisionContinue
+				case 'D': // ^[OD: Arrow left
+					cursorLeftCharacter(l)
+					return iterationDecisionContinue
+				case 'C': // ^[OC: Arrow right
+					cursorRightCharacter(l)
+					return iterationDecisionContinue
+				case 'H': // ^[OH: Home
+					goHome(l)
+					return iterationDecisionContinue
+				case 'F': // ^[OF: End
+					goEnd(l)
+					return iterationDecisionContinue
+				case 'M': // ^[OM: Keypad enter
+					codePoint = '\n'
+				case 'X': // ^[OX: Keypad '='
+					codePoint = '='
+				case 'j', 'k', 'l', 'm', 'n', 'o': // ^[Oj..^[Oo: Keypad '*', '+', ',', '-', '.', '/'
+					codePoint = []rune("*+,-./")[codePoint-'j']
+				default:
+					if codePoint >= 'p' && codePoint <= 'y' { // ^[Op..^[Oy: Keypad digits
+						codePoint = '0' + (codePoint - 'p')
+						break
+					}
+					return iterationDecisionContinue
+				}
+				// Keypad keys behave exactly like their main keyboard counterparts from here on.
 			case inputStateVerbatim:
 				l.state = inputStateFree
 				// Verbatim mode will bypass all mechanisms and just insert the character.
@@ -1872,6 +3727,9 @@ func (l *lineEditor) handleReadEvent() {
 					l.state = inputStateGotEscape
 					return iterationDecisionContinue
 				}
+				if len(l.limitPaste([]rune{codePoint})) == 0 {
+					return iterationDecisionContinue
+				}
 				if l.pasteHandler != nil {
 					l.pasteBuffer = append(l.pasteBuffer, codePoint)
 				} else {
@@ -1880,15 +3738,34 @@ func (l *lineEditor) handleReadEvent() {
 				return iterationDecisionContinue
 			case inputStateFree:
 				l.previousFreeState = inputStateFree
+				if codePoint == '\r' && l.rawModeFlags&RawModeCRToNL != 0 {
+					// The terminal isn't turning Enter into a newline for us anymore.
+					codePoint = '\n'
+				}
+				if codePoint == 27 && l.IsShowingCompletions() && consumedCodePoints == len(inputView) && l.waitForInput(rawSequenceTimeout) {
+					// The rest of what's likely a sequence came in after all, take it all from the top.
+					consumedCodePoints--
+					consumedBytes -= inputSizes[index]
+					return iterationDecisionBreak
+				}
+				if l.inputLogger != nil {
+					l.inputLogger([]byte(string(codePoint)), describeKey(codePoint))
+				}
 				if codePoint == 27 {
-					l.keyCallbackMachine.keyPressed(key{key: uint32(codePoint)}, l)
+					if l.IsShowingCompletions() && consumedCodePoints == len(inputView) {
+						// Nothing came along with it, even after waiting a moment, so this is the Escape key by
+						// itself rather than the start of a sequence; have it close the suggestions, keeping what's in the buffer.
+						l.CommitPendingCompletion()
+						return iterationDecisionContinue
+					}
+					l.keyCallbackMachine.keyPressed(KeyPress{key: uint32(codePoint)}, l)
 					if l.keyCallbackMachine.shouldProcessLastPressedKey() {
 						l.state = inputStateGotEscape
 					}
 					return iterationDecisionContinue
 				}
 				if codePoint == 22 { // ^v
-					l.keyCallbackMachine.keyPressed(key{key: uint32(codePoint)}, l)
+					l.keyCallbackMachine.keyPressed(KeyPress{key: uint32(codePoint)}, l)
 					if l.keyCallbackMachine.shouldProcessLastPressedKey() {
 						l.state = inputStateVerbatim
 					}
@@ -1899,7 +3776,8 @@ func (l *lineEditor) handleReadEvent() {
 			// There are no sequences past this point, so short of 'tab', we will want to cleanup the suggestions
 			shouldCleanupSuggestions := true
 			defer func() {
-				if shouldCleanupSuggestions {
+				// Submitting keeps the suggestion shown but not its style, reallyQuitEventLoop settles the completion instead.
+				if shouldCleanupSuggestions && !l.finish {
 					l.cleanupSuggestions()
 				}
 			}()
@@ -1907,161 +3785,256 @@ func (l *lineEditor) handleReadEvent() {
 			// Normally ^d, `stty eof \^n` can change it to ^N (or whatever).
 			// Process this here since keybinds might override its behaviour
 			// This only applies when the buffer is empty, at any other time, the behaviour should be configurable.
-			if codePoint == rune(l.termios.Cc[unix.VEOF]) && len(l.buffer) == 0 {
+			if codePoint != 0 && codePoint == rune(l.termios.Cc[unix.VEOF]) && len(l.buffer) == 0 {
 				finishEdit(l)
 				return iterationDecisionContinue
 			}
 
-			l.keyCallbackMachine.keyPressed(key{key: uint32(codePoint)}, l)
+			l.keyCallbackMachine.keyPressed(KeyPress{key: uint32(codePoint)}, l)
 			if !l.keyCallbackMachine.shouldProcessLastPressedKey() {
+				l.hasSelection = false
 				return iterationDecisionContinue
 			}
 
 			l.searchOffset = 0 // reset search offset on any key
+			l.hasHistoryStash = false
+
+			if index, ok := l.suggestionDisplay.quickSelectIndex(codePoint); ok && l.timesTabPressed > 1 {
+				shouldCleanupSuggestions = false
+				l.CommitSuggestion(index)
+				return iterationDecisionContinue
+			}
 
 			if codePoint == '\t' || reverseTab {
 				shouldCleanupSuggestions = false
-				if l.tabCompletionHandler == nil {
-					return iterationDecisionContinue
-				}
+				l.handleTabCompletion(reverseTab, false)
+				reverseTab = false
+				return iterationDecisionContinue
+			}
 
-				// Reverse tab can count as regular tab here.
-				l.timesTabPressed++
+			// If we got here, manually cleanup the suggestions and then insert the new code point.
+			l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
+			shouldCleanupSuggestions = false
+			l.cleanupSuggestions()
+			if codePoint == 0 {
+				// An unbound ^@ has nothing to insert.
+				return iterationDecisionContinue
+			}
+			// Typing over a selection replaces it.
+			l.DeleteSelection()
+			l.InsertChar(codePoint)
 
-				tokenStart := l.cursor
+			return iterationDecisionContinue
+		}() == iterationDecisionBreak {
+			break
+		}
+	}
 
-				if l.timesTabPressed == 1 {
-					l.suggestionManager.setSuggestions(l.tabCompletionHandler(l))
-					l.suggestionManager.setStartIndex(0)
-					l.promptLinesAtSuggestionInitiation = l.NumLines()
-					if l.suggestionManager.count() == 0 {
-						// There are no suggestions, beep
-						os.Stderr.Write([]byte{'\a'})
-					}
-				}
+	if consumedBytes == len(l.incompleteData) {
+		l.incompleteData = l.incompleteData[:0]
+	} else {
+		l.incompleteData = l.incompleteData[consumedBytes:]
+	}
 
-				// Adjust already incremented / decremented index when switching tab direction
-				if reverseTab && l.tabDirection != tabDirectionBackward {
-					l.suggestionManager.previous()
-					l.suggestionManager.previous()
-					l.tabDirection = tabDirectionBackward
-				}
-				if !reverseTab && l.tabDirection != tabDirectionForward {
-					l.suggestionManager.next()
-					l.suggestionManager.next()
-					l.tabDirection = tabDirectionForward
-				}
-				reverseTab = false
+	if utf8.FullRune(l.incompleteData) && !l.finish {
+		if len(l.laterChan) < 4 {
+			l.laterChan <- laterEventCodeTryUpdateOnce
+		}
+	}
+}
 
-				var mode completionMode
-				switch l.timesTabPressed {
-				case 1:
-					mode = completionModeCompletePrefix
-				case 2:
-					mode = completionModeShowSuggestions
-				default:
-					mode = completionModeCycleSuggestions
-				}
+// CommitSuggestion commits to the suggestion at index among the current ones, as if it were tabbed to.
+// It returns false if there is no such suggestion, e.g. because completion hasn't been started.
+func (l *lineEditor) CommitSuggestion(index uint32) bool {
+	if l.timesTabPressed == 0 || index >= l.suggestionManager.count() {
+		return false
+	}
 
-				l.InsertString(string(l.rememberedSuggestionStaticData))
-				l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
+	// Pretend this is a forward tab landing right on the selected suggestion.
+	l.suggestionManager.setNextIndex(index)
+	l.tabDirection = tabDirectionForward
+	l.handleTabCompletion(false, true)
+	return true
+}
 
-				completionResult := l.suggestionManager.attemptCompletion(mode, tokenStart)
-				newCursor := l.cursor
+// handleTabCompletion runs one step of tab completion, going backwards through the suggestions if reverse is set.
+// If commit is set, the suggestion this step lands on is committed to right away.
+func (l *lineEditor) handleTabCompletion(reverse bool, commit bool) {
+	if l.tabCompletionHandler == nil {
+		return
+	}
 
-				newCursor += completionResult.newCursorOffset
-				for i := completionResult.offsetStartToRemove; i < completionResult.offsetEndToRemove; i++ {
-					l.removeAtIndex(newCursor)
-				}
+	if l.timesTabPressed == 0 && l.minCompletionPrefix > 0 {
+		if _, start, _ := l.TokenAtCursor(); l.cursor-start < l.minCompletionPrefix {
+			l.ringBell()
+			return
+		}
+	}
 
-				newCursor -= completionResult.staticOffsetFromCursor
-				for i := uint32(0); i < completionResult.staticOffsetFromCursor; i++ {
-					l.rememberedSuggestionStaticData = append(l.rememberedSuggestionStaticData, l.buffer[newCursor])
-					l.removeAtIndex(newCursor)
-				}
+	// Reverse tab can count as regular tab here.
+	l.timesTabPressed++
 
-				l.cursor = newCursor
-				l.inlineSearchCursor = l.cursor
-				l.refreshNeeded = true
-				l.charsTouchedInTheMiddle++
+	tokenStart := l.cursor
 
-				l.InsertString(string(completionResult.insert))
+	if l.timesTabPressed == 1 {
+		suggestions := l.tabCompletionHandler(l)
+		if l.tokenizer != nil {
+			l.fillCompletionOffsets(suggestions)
+		}
+		l.suggestionManager.setSuggestions(suggestions)
+		l.suggestionManager.setStartIndex(0)
+		l.promptLinesAtSuggestionInitiation = l.NumLines()
+		if l.suggestionManager.count() == 0 {
+			// There are no suggestions, beep
+			l.ringBell()
+		}
+	}
 
-				l.repositionCursor(os.Stderr, false)
+	// Adjust already incremented / decremented index when switching tab direction
+	if reverse && l.tabDirection != tabDirectionBackward {
+		l.suggestionManager.previous()
+		l.suggestionManager.previous()
+		l.tabDirection = tabDirectionBackward
+	}
+	if !reverse && l.tabDirection != tabDirectionForward {
+		l.suggestionManager.next()
+		l.suggestionManager.next()
+		l.tabDirection = tabDirectionForward
+	}
 
-				if completionResult.hasStyleToApply {
-					// Apply the style of the last suggestion
-					l.Stylize(Span{l.suggestionManager.currentSuggestion().StartIndex, l.cursor, SpanModeRune}, completionResult.styleToApply)
-				}
+	var mode completionMode
+	switch l.timesTabPressed {
+	case 1:
+		mode = completionModeCompletePrefix
+	case 2:
+		mode = completionModeShowSuggestions
+	default:
+		mode = completionModeCycleSuggestions
+	}
 
-				switch completionResult.newCompletionMode {
-				case completionModeDontComplete:
-					l.timesTabPressed = 0
-					l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
-				case completionModeCompletePrefix:
-					l.timesTabPressed++
-					l.timesTabPressed--
-				default:
-					l.timesTabPressed++
-				}
+	rememberedStaticData := append([]rune{}, l.rememberedSuggestionStaticData...)
+	l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
 
-				if l.timesTabPressed > 1 && l.suggestionManager.count() > 0 {
-					if l.suggestionDisplay.cleanup() {
-						l.repositionCursor(os.Stderr, false)
-					}
-					l.suggestionDisplay.setInitialPromptLines(l.promptLinesAtSuggestionInitiation)
-					l.suggestionDisplay.display(l.suggestionManager)
-					l.originRow = l.suggestionDisplay.originRow()
-				}
+	completionResult := l.suggestionManager.attemptCompletion(mode, tokenStart)
+	if completionResult.ringBell {
+		l.ringBell()
+	}
+	newCursor := l.cursor
+
+	newCursor += completionResult.newCursorOffset
+	// Snippets may span several lines, and so may whatever they replace.
+	spansLines := strings.ContainsRune(string(completionResult.insert)+string(rememberedStaticData), '\n')
+	for i := completionResult.offsetStartToRemove; i < completionResult.offsetEndToRemove; i++ {
+		spansLines = spansLines || newCursor < uint32(len(l.buffer)) && l.buffer[newCursor] == '\n'
+		l.removeAtIndex(newCursor)
+	}
 
-				if l.timesTabPressed > 2 {
-					if l.tabDirection == tabDirectionForward {
-						l.suggestionManager.next()
-					} else {
-						l.suggestionManager.previous()
-					}
-				}
+	// Put back what the previous suggestion replaced, right where it was taken from,
+	// so the next suggestion starts from the buffer as it was before completion.
+	l.cursor = newCursor
+	l.InsertString(string(rememberedStaticData))
+	newCursor = l.cursor
 
-				if l.suggestionManager.count() < 2 && !completionResult.avoidCommittingToSingleSuggestion {
-					// We have none, or just one suggestion,
-					// we should just commit that and continue
-					// after it, as if it were auto-completed.
-					l.repositionCursor(os.Stderr, true)
-					l.cleanupSuggestions()
-					l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
-				}
-				return iterationDecisionContinue
-			}
+	newCursor -= completionResult.staticOffsetFromCursor
+	for i := uint32(0); i < completionResult.staticOffsetFromCursor; i++ {
+		l.rememberedSuggestionStaticData = append(l.rememberedSuggestionStaticData, l.buffer[newCursor])
+		l.removeAtIndex(newCursor)
+	}
 
-			// If we got here, manually cleanup the suggestions and then insert the new code point.
-			l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
-			shouldCleanupSuggestions = false
-			l.cleanupSuggestions()
-			l.InsertChar(codePoint)
+	l.cursor = newCursor
+	l.inlineSearchCursor = l.cursor
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
 
-			return iterationDecisionContinue
-		}() == iterationDecisionBreak {
-			break
-		}
+	l.InsertString(string(completionResult.insert))
+
+	if spansLines {
+		// The buffer doesn't take up as many lines as it did, so neither the cursor nor the suggestions
+		// can be placed against what's on screen; clear it all and reflow the buffer right away.
+		l.suggestionDisplay.cleanup()
+		vtMoveAbsolute(l.originRow, 1, os.Stderr)
+		vtClearToEndOfScreen(os.Stderr)
+		l.refreshNeeded = true
+		l.refreshDisplay()
+		// Drawing may have scrolled the terminal.
+		l.setOriginValue(l.originRow, l.originColumn)
+		l.promptLinesAtSuggestionInitiation = max(l.promptLinesAtSuggestionInitiation, l.NumLines())
 	}
 
-	if consumedCodePoints == len(l.incompleteData) {
-		l.incompleteData = l.incompleteData[:0]
-	} else {
-		l.incompleteData = l.incompleteData[consumedCodePoints:]
+	l.repositionCursor(os.Stderr, false)
+
+	if completionResult.hasStyleToApply {
+		// Apply the style of the last suggestion
+		l.stylizeSuggestion(l.suggestionManager.currentSuggestion().StartIndex, l.cursor, completionResult.styleToApply)
 	}
 
-	if len(l.incompleteData) != 0 && !l.finish {
-		if len(l.laterChan) < 4 {
-			l.laterChan <- laterEventCodeTryUpdateOnce
+	switch completionResult.newCompletionMode {
+	case completionModeDontComplete:
+		l.timesTabPressed = 0
+		l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
+	case completionModeCompletePrefix:
+		l.timesTabPressed++
+		l.timesTabPressed--
+	default:
+		l.timesTabPressed++
+	}
+
+	if !commit && l.timesTabPressed > 1 && l.suggestionManager.count() > 0 {
+		if l.suggestionDisplay.cleanup() {
+			l.repositionCursor(os.Stderr, false)
+		}
+		l.suggestionDisplay.setInitialPromptLines(l.promptLinesAtSuggestionInitiation)
+		l.suggestionDisplay.display(l.suggestionManager)
+		l.originRow = l.suggestionDisplay.originRow()
+	}
+
+	if l.timesTabPressed > 2 {
+		if l.tabDirection == tabDirectionForward {
+			l.suggestionManager.next()
+		} else {
+			l.suggestionManager.previous()
 		}
 	}
+
+	if commit || (l.suggestionManager.count() < 2 && !completionResult.avoidCommittingToSingleSuggestion) {
+		// We have none, or just one suggestion (or were asked to commit),
+		// we should just commit that and continue
+		// after it, as if it were auto-completed.
+		l.repositionCursor(os.Stderr, true)
+		l.cleanupSuggestions()
+		l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
+	}
+}
+
+// IsShowingCompletions returns whether the list of suggestions is on screen.
+func (l *lineEditor) IsShowingCompletions() bool {
+	return l.timesTabPressed > 0 && l.suggestionDisplay.isShowing()
+}
+
+// CommitPendingCompletion keeps the suggestion currently in the buffer (if a completion is in progress),
+// as if a key other than tab was pressed, but without the style it's shown in; the suggestions are cleared
+// away and the buffer stays as it is shown.
+func (l *lineEditor) CommitPendingCompletion() {
+	if l.timesTabPressed == 0 {
+		return
+	}
+
+	l.rememberedSuggestionStaticData = l.rememberedSuggestionStaticData[:0]
+	l.unstylizeSuggestion()
+	l.refreshNeeded = true
+
+	if l.suggestionDisplay.cleanup() {
+		l.repositionCursor(os.Stderr, false)
+	}
+	l.suggestionManager.reset()
+	l.suggestionDisplay.finish()
+	l.timesTabPressed = 0
 }
 
 func (l *lineEditor) cleanupSuggestions() {
 	if l.timesTabPressed != 0 {
 		// Apply the style of the last suggestion
-		l.Stylize(Span{l.suggestionManager.currentSuggestion().StartIndex, l.cursor, SpanModeRune}, l.suggestionManager.currentSuggestion().Style)
+		l.stylizeSuggestion(l.suggestionManager.currentSuggestion().StartIndex, l.cursor, l.suggestionManager.currentSuggestion().Style)
 		// We probably have some suggestions drawn,
 		// let's clean them up.
 		if l.suggestionDisplay.cleanup() {
@@ -2074,15 +4047,193 @@ func (l *lineEditor) cleanupSuggestions() {
 	l.timesTabPressed = 0
 }
 
+// stylizeSuggestion applies the style of a committed suggestion to its text, replacing the style of the previous one.
+// Unlike spans from Stylize, this one follows its text around as the buffer is edited, see adjustSuggestionStyle.
+func (l *lineEditor) stylizeSuggestion(start, end uint32, style Style) {
+	if style.IsEmpty() || start >= end {
+		return
+	}
+
+	l.unstylizeSuggestion()
+	l.Stylize(Span{start, end, SpanModeRune}, style)
+	l.suggestionStyle = style
+	l.suggestionStyleStart = start
+	l.suggestionStyleEnd = end
+	l.hasSuggestionStyle = true
+}
+
+func (l *lineEditor) unstylizeSuggestion() {
+	if !l.hasSuggestionStyle {
+		return
+	}
+
+	l.hasSuggestionStyle = false
+	l.removeSpan(l.suggestionStyleStart, l.suggestionStyleEnd)
+}
+
+// removeSpan drops the style of the span [start, end) (in code points) that was added with Stylize.
+func (l *lineEditor) removeSpan(start, end uint32) {
+	if starting := l.currentSpans.spansStarting[start]; starting != nil {
+		delete(starting, end)
+		if len(starting) == 0 {
+			delete(l.currentSpans.spansStarting, start)
+		}
+	}
+	if ending := l.currentSpans.spansEnding[end]; ending != nil {
+		delete(ending, start)
+		if len(ending) == 0 {
+			delete(l.currentSpans.spansEnding, end)
+		}
+	}
+	l.refreshNeeded = true
+}
+
+// Selection returns the selected range, the selection runs between where it was started (the anchor) and the cursor.
+func (l *lineEditor) Selection() (start, end uint32, ok bool) {
+	if !l.hasSelection {
+		return 0, 0, false
+	}
+	// Edits might have shrunk the buffer under the anchor.
+	l.selectionAnchor = min(l.selectionAnchor, uint32(len(l.buffer)))
+	return min(l.selectionAnchor, l.cursor), max(l.selectionAnchor, l.cursor), true
+}
+
+// SetSelection selects the range between anchor and cursor, and moves the cursor there.
+func (l *lineEditor) SetSelection(anchor, cursor uint32) {
+	l.selectionAnchor = min(anchor, uint32(len(l.buffer)))
+	l.hasSelection = true
+	l.cursor = min(cursor, uint32(len(l.buffer)))
+	l.inlineSearchCursor = l.cursor
+}
+
+func (l *lineEditor) ClearSelection() {
+	l.hasSelection = false
+}
+
+func (l *lineEditor) SetSelectionStyle(style Style) {
+	l.selectionStyle = style
+	// Make sure the next refresh redraws the selection with the new style.
+	l.hasDrawnSelection = l.hasDrawnSelection || l.hasSelection
+}
+
+// DeleteSelection removes the selected text, and returns whether there was anything selected.
+func (l *lineEditor) DeleteSelection() bool {
+	start, end, ok := l.Selection()
+	l.hasSelection = false
+	if !ok || start == end {
+		return false
+	}
+
+	for i := start; i < end; i++ {
+		l.removeAtIndex(start)
+	}
+	l.cursor = start
+	l.inlineSearchCursor = l.cursor
+	l.refreshNeeded = true
+	return true
+}
+
+// ReplaceSelection replaces the selected text with text, and returns whether there was a selection to replace.
+func (l *lineEditor) ReplaceSelection(text string) bool {
+	if !l.hasSelection {
+		return false
+	}
+
+	l.DeleteSelection()
+	l.InsertString(text)
+	return true
+}
+
+// extendSelection starts a selection at the cursor if there isn't one, or drops the selection if extend is false.
+// It is called before the cursor moves, so the cursor always ends up at the moving end of the selection.
+func (l *lineEditor) extendSelection(extend bool) {
+	if !extend {
+		l.hasSelection = false
+		return
+	}
+	if !l.hasSelection {
+		l.selectionAnchor = l.cursor
+		l.hasSelection = true
+	}
+}
+
+// updateSelectionStyle moves the selection's highlight to where the selection is now.
+func (l *lineEditor) updateSelectionStyle() {
+	start, end, ok := l.Selection()
+	ok = ok && start != end
+	if ok == l.hasDrawnSelection && (!ok || start == l.drawnSelectionStart && end == l.drawnSelectionEnd) {
+		return
+	}
+
+	if l.hasDrawnSelection {
+		l.removeSpan(l.drawnSelectionStart, l.drawnSelectionEnd)
+	}
+	l.hasDrawnSelection = ok
+	if ok {
+		l.Stylize(Span{start, end, SpanModeRune}, l.selectionStyle)
+		l.drawnSelectionStart = start
+		l.drawnSelectionEnd = end
+	}
+	// The highlight can change anywhere in the line, so redraw all of it.
+	l.refreshNeeded = true
+	l.charsTouchedInTheMiddle++
+}
+
+// adjustSuggestionStyle keeps the committed suggestion's style on the suggestion's text
+// when count code points are inserted at, or removed from, index.
+func (l *lineEditor) adjustSuggestionStyle(index, count uint32, inserted bool) {
+	if !l.hasSuggestionStyle || index >= l.suggestionStyleEnd {
+		return
+	}
+
+	start, end, style := l.suggestionStyleStart, l.suggestionStyleEnd, l.suggestionStyle
+	l.unstylizeSuggestion()
+	if index > start || (index == start && !inserted) {
+		// The suggestion itself was edited, it no longer deserves its style.
+		return
+	}
+
+	if inserted {
+		l.stylizeSuggestion(start+count, end+count, style)
+	} else {
+		l.stylizeSuggestion(start-count, end-count, style)
+	}
+}
+
 func (l *lineEditor) removeAtIndex(index uint32) {
-	cp := l.buffer[index]
-	l.buffer = append(l.buffer[:index], l.buffer[index+1:]...)
-	if cp == '\n' {
-		l.extraForwardLines++
+	if l.hasMark && index < l.mark {
+		l.mark--
+	}
+	if l.hasSelection && index < l.selectionAnchor {
+		l.selectionAnchor--
 	}
+	l.adjustSuggestionStyle(index, 1, false)
+	l.markBufferChanged()
+	l.buffer = append(l.buffer[:index], l.buffer[index+1:]...)
 	l.charsTouchedInTheMiddle++
 }
 
+// firstSearchableHistoryEntry returns the index of the oldest history entry searches cover.
+func (l *lineEditor) firstSearchableHistoryEntry() uint32 {
+	if l.historySearchScope == HistorySearchScopeSession {
+		return l.sessionHistoryStart
+	}
+	return 0
+}
+
+// countHistoryPrefixMatches returns how many of the history entries searches cover start with prefix.
+func (l *lineEditor) countHistoryPrefixMatches(prefix string) uint32 {
+	count := uint32(0)
+	for i := l.historyCursor; i > l.firstSearchableHistoryEntry(); i-- {
+		if strings.HasPrefix(l.history[i-1].entry, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// search loads the history entry searchOffset matches back that contains (or starts with) phrase,
+// and returns whether there was one; it's up to the caller to complain if not.
 func (l *lineEditor) search(phrase string, allowEmpty bool, fromBeginning bool) bool {
 	lastMatchingOffset := -1
 	found := false
@@ -2090,7 +4241,7 @@ func (l *lineEditor) search(phrase string, allowEmpty bool, fromBeginning bool)
 	// Do not search for empty strings.
 	if allowEmpty || len(phrase) > 0 {
 		searchOffset := l.searchOffset
-		for i := l.historyCursor; i > 0; i-- {
+		for i := l.historyCursor; i > l.firstSearchableHistoryEntry(); i-- {
 			entry := &l.history[i-1]
 			contains := false
 			if fromBeginning {
@@ -2108,10 +4259,6 @@ func (l *lineEditor) search(phrase string, allowEmpty bool, fromBeginning bool)
 				searchOffset--
 			}
 		}
-
-		if !found {
-			os.Stderr.Write([]byte("\a"))
-		}
 	}
 
 	if found {
@@ -2120,6 +4267,8 @@ func (l *lineEditor) search(phrase string, allowEmpty bool, fromBeginning bool)
 		l.buffer = l.buffer[:0]
 		l.cursor = 0
 		l.InsertString(l.history[lastMatchingOffset].entry)
+		l.historyIndex = uint32(lastMatchingOffset)
+		l.hasHistoryIndex = true
 		// Always needed, as we have cleared the buffer.
 		l.refreshNeeded = true
 	}
@@ -2132,6 +4281,7 @@ func (l *lineEditor) endSearch() {
 	l.refreshNeeded = true
 	l.searchOffset = 0
 	if l.resetBufferOnSearchEnd {
+		l.markBufferChanged()
 		l.buffer = l.buffer[:0]
 		l.buffer = append(l.buffer, l.preSearchBuffer...)
 		l.cursor = l.preSearchCursor
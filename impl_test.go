@@ -0,0 +1,1246 @@
+package line
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNormalization(t *testing.T) {
+	// The same word, typed once with a composed é and once with e and a combining acute accent.
+	const typed = "caf\u00e9 cafe\u0301"
+	tests := []struct {
+		form Normalization
+		want string
+	}{
+		{NormNone, typed},
+		{NormNFC, "caf\u00e9 caf\u00e9"},
+		{NormNFD, "cafe\u0301 cafe\u0301"},
+	}
+	for _, test := range tests {
+		if line := normalize(typed, test.form); line != test.want {
+			t.Errorf("normalization %d returned %+q, want %+q", test.form, line, test.want)
+		}
+	}
+}
+
+func TestTriggerInterruptAfterGetLine(t *testing.T) {
+	newTestTerminal(t, 24, 80)
+	withInput(t, "abc\n")
+	l := NewEditor().(*lineEditor)
+	withoutCursorPositionReports(t)
+
+	line, err := l.GetLine("> ")
+	if err != nil || line != "abc" {
+		t.Fatalf("GetLine returned %q, %v", line, err)
+	}
+	if l.IsEditing() {
+		t.Error("still editing after GetLine returned")
+	}
+	// There's no line to interrupt, this must do nothing rather than block or send on a closed channel.
+	l.TriggerInterrupt()
+}
+
+// TestTriggerInterruptFromOtherGoroutines is best run with -race.
+func TestTriggerInterruptFromOtherGoroutines(t *testing.T) {
+	newTestTerminal(t, 24, 80)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the line open, nothing but an interrupt ends it.
+	defer w.Close()
+	if _, err := w.WriteString("abc"); err != nil {
+		t.Fatal(err)
+	}
+	readFrom(t, r)
+
+	l := NewEditor().(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.SetReturnLineOnInterrupt(true)
+	typed := make(chan struct{})
+	l.SetInputLogger(func(raw []byte, decoded string) {
+		if string(raw) == "c" {
+			close(typed)
+		}
+	})
+
+	// More interrupts than there's room for, from all over, both while the line is edited and after it's returned.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-typed
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					l.TriggerInterrupt()
+				}
+			}
+		}()
+	}
+
+	line, err := l.GetLine("> ")
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if line != "abc" || !errors.Is(err, ErrInterrupted) {
+		t.Errorf("GetLine returned %q, %v", line, err)
+	}
+}
+
+func TestSetBracketedPasteEnabledOutsideGetLine(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	withInput(t, "\x14abc\n")
+	l := NewEditorWithConfig(&Config{BracketedPaste: BracketedPasteDisabled}).(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.Initialize()
+	l.RegisterKeybinding([]KeyPress{Ctrl('T')}, func(_ []KeyPress, editor Editor) bool {
+		editor.SetBracketedPasteEnabled(true)
+		return false
+	})
+
+	if _, err := l.GetLine("> "); err != nil {
+		t.Fatal(err)
+	}
+	if output := term.update(); !strings.Contains(output, "\x1b[?2004h") || !strings.HasSuffix(output, "\x1b[?2004l") {
+		t.Errorf("bracketed paste wasn't turned on while editing and off on return, output was %q", output)
+	}
+
+	// Between lines the terminal belongs to the program, which isn't expecting pastes to come with markers.
+	l.SetBracketedPasteEnabled(false)
+	l.SetBracketedPasteEnabled(true)
+	if output := term.update(); output != "" {
+		t.Errorf("wrote %q between lines", output)
+	}
+}
+
+func TestSetFocusReportingEnabledOutsideGetLine(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	withInput(t, "\x14abc\n")
+	l := NewEditor().(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.Initialize()
+	l.RegisterKeybinding([]KeyPress{Ctrl('T')}, func(_ []KeyPress, editor Editor) bool {
+		editor.SetFocusReportingEnabled(true)
+		return false
+	})
+
+	if _, err := l.GetLine("> "); err != nil {
+		t.Fatal(err)
+	}
+	if output := term.update(); !strings.Contains(output, "\x1b[?1004h") || !strings.HasSuffix(output, "\x1b[?1004l") {
+		t.Errorf("focus reporting wasn't turned on while editing and off on return, output was %q", output)
+	}
+
+	l.SetFocusReportingEnabled(false)
+	l.SetFocusReportingEnabled(true)
+	if output := term.update(); output != "" {
+		t.Errorf("wrote %q between lines", output)
+	}
+}
+
+func TestAltOAndSS3(t *testing.T) {
+	l := newTestEditor(t)
+	altO := 0
+	l.RegisterKeybinding([]KeyPress{Alt('O')}, func(_ []KeyPress, _ Editor) bool {
+		altO++
+		return false
+	})
+	l.AddToHistory("older")
+	l.historyCursor = uint32(len(l.history))
+
+	// Alt-O, then a key typed a moment later.
+	feed(l, "\x1bO")
+	feed(l, "x")
+	// Alt-O and a key that no ^[O sequence ends in, all at once.
+	feed(l, "\x1bOz")
+	if altO != 2 || l.Line() != "xz" {
+		t.Fatalf("Alt-O was pressed %d times and the line is %q, want 2 and \"xz\"", altO, l.Line())
+	}
+
+	// Arrow up in application cursor mode.
+	l.SetLine("")
+	feed(l, "\x1bOA")
+	if altO != 2 || l.Line() != "older" {
+		t.Errorf("^[OA pressed Alt-O or didn't go up in the history, the line is %q", l.Line())
+	}
+}
+
+func TestRegisterKeybindingStringAltO(t *testing.T) {
+	tests := []struct {
+		spec   string
+		inputs []string
+	}{
+		{"M-O", []string{"\x1bO"}},
+		// Pressed one after the other.
+		{"M-O a", []string{"\x1bO", "a"}},
+		{`"\eOA"`, []string{"\x1bOA"}},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		pressed := false
+		if err := l.RegisterKeybindingString(test.spec, func(_ []KeyPress, _ Editor) bool {
+			pressed = true
+			return false
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range test.inputs {
+			feed(l, input)
+		}
+		if !pressed || l.Line() != "" {
+			t.Errorf("%s wasn't pressed by %q, the line is %q", test.spec, test.inputs, l.Line())
+		}
+	}
+}
+
+func TestOperateAndGetNextAtHistoryCapacity(t *testing.T) {
+	newTestTerminal(t, 24, 80)
+	// Go up to the oldest entry and accept it with ^O, then accept what the next line starts out with.
+	withInput(t, "\x1b[A\x1b[A\x1b[A\x0f\n")
+	l := NewEditorWithConfig(&Config{HistoryCapacity: 3}).(*lineEditor)
+	withoutCursorPositionReports(t)
+	for _, entry := range []string{"a", "b", "c"} {
+		l.AddToHistory(entry)
+	}
+
+	line, err := l.GetLine("> ")
+	if err != nil || line != "a" {
+		t.Fatalf("GetLine returned %q, %v, want \"a\"", line, err)
+	}
+	// Which pushes "a" out of the history, and "b" down to where "a" was.
+	l.AddToHistory(line)
+
+	line, err = l.GetLine("> ")
+	if err != nil || line != "b" {
+		t.Errorf("the line after the ^O'd one was %q, %v, want \"b\"", line, err)
+	}
+}
+
+func TestBellStyle(t *testing.T) {
+	tests := []struct {
+		style BellStyle
+		want  string
+	}{
+		{BellStyleAudible, "\a"},
+		{BellStyleVisible, "\x1b[?5h\x1b[?5l"},
+		{BellStyleNone, ""},
+	}
+	for _, test := range tests {
+		term := newTestTerminal(t, 24, 80)
+		l := newTestEditorOn(t, term)
+		l.SetBellStyle(test.style)
+		term.update()
+
+		// Nothing to complete rings the bell.
+		l.SetTabCompletionHandler(func(_ Editor) []Completion { return nil })
+		feed(l, "\t")
+		// The refresh after it doesn't ring anything.
+		output := term.update()
+		if bell := output[:strings.Index(output, "\x1b[1;3H")]; bell != test.want {
+			t.Errorf("bell style %d wrote %q, want %q", test.style, bell, test.want)
+		}
+	}
+}
+
+func TestPanicInRefreshHandler(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	withInput(t, "abc\n")
+	l := NewEditor().(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.SetRefreshHandler(func(editor Editor) {
+		if strings.Contains(editor.Line(), "b") {
+			panic("oops")
+		}
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "oops" {
+				t.Errorf("recovered %v, want the handler's panic", r)
+			}
+		}()
+		_, _ = l.GetLine("> ")
+		t.Error("GetLine returned")
+	}()
+
+	if l.initialized || l.isEditing {
+		t.Error("the terminal wasn't restored")
+	}
+	if output := term.update(); !strings.HasSuffix(output, "\x1b[?2004l") || !strings.Contains(output, "\x1b[22;24;23m") {
+		t.Errorf("styles weren't reset and bracketed paste turned off, output ends in %q", output[maxInt(0, len(output)-40):])
+	}
+}
+
+func TestPanicsDisabled(t *testing.T) {
+	newTestTerminal(t, 24, 80)
+	withInput(t, "\x14abc\n")
+	l := NewEditorWithConfig(&Config{AllowPanics: PanicsDisabled}).(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.Initialize()
+	l.RegisterKeybinding([]KeyPress{Ctrl('T')}, func(_ []KeyPress, _ Editor) bool {
+		panic("oops")
+	})
+
+	if _, err := l.GetLine("> "); !errors.Is(err, ErrPanicked) {
+		t.Errorf("GetLine returned %v, want ErrPanicked", err)
+	}
+	if l.isEditing {
+		t.Error("still editing after the panic")
+	}
+}
+
+func TestSubmitMidCompletion(t *testing.T) {
+	bold := Style{Bold: true}
+	tests := []struct {
+		name        string
+		completions []Completion
+		input       string
+		want        string
+	}{
+		// The first tab lists the suggestions, the second one puts the first of them in; whichever is shown is submitted.
+		{"shown", []Completion{{Text: "foobar", InvariantOffset: 2, Style: bold}, {Text: "foobaz", InvariantOffset: 2, Style: bold}}, "fo\t\t\n", "foobar"},
+		{"cycled", []Completion{{Text: "foobar", InvariantOffset: 2, Style: bold}, {Text: "foobaz", InvariantOffset: 2, Style: bold}}, "fo\t\t\t\n", "foobaz"},
+		// The common prefix goes in on the first tab.
+		{"prefix", []Completion{{Text: "foobar", InvariantOffset: 2, AllowCommitWithoutListing: true}, {Text: "foobaz", InvariantOffset: 2, AllowCommitWithoutListing: true}}, "fo\t\t\n", "foobar"},
+		{"static", []Completion{{Text: "bar", StaticOffset: 2, Style: bold}, {Text: "qux", StaticOffset: 2, Style: bold}}, "fo\t\t\n", "bar"},
+	}
+	for _, test := range tests {
+		term := newTestTerminal(t, 24, 80)
+		l := newTestEditorOn(t, term)
+		l.SetTabCompletionHandler(func(_ Editor) []Completion { return test.completions })
+		feed(l, test.input)
+
+		if line := l.returnedLine; line != test.want {
+			t.Errorf("%s: submitted %q, want %q", test.name, line, test.want)
+		}
+		if screen := term.String(); screen != "> "+test.want {
+			t.Errorf("%s: left %q on screen, want %q", test.name, screen, "> "+test.want)
+		}
+		if l.hasSuggestionStyle || len(l.currentSpans.spansStarting) != 0 {
+			t.Errorf("%s: the suggestion's style stayed on the line", test.name)
+		}
+	}
+}
+
+func TestPasteDetectionThreshold(t *testing.T) {
+	tests := []struct {
+		threshold int
+		input     string
+		want      string
+	}{
+		// Shorter than a full read, but past the threshold.
+		{8, "ab\tcd\tef", "ab\tcd\tef"},
+		// Longer than a full read.
+		{20, "abc\tdef\tghi\tjkl\tmno\tpqr", "abc\tdef\tghi\tjkl\tmno\tpqr"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.SetPasteDetectionThreshold(test.threshold)
+		l.SetTabCompletionHandler(func(_ Editor) []Completion {
+			t.Errorf("pasting %q started completing", test.input)
+			return nil
+		})
+		withInput(t, test.input)
+		l.handleReadEvent()
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("pasting %q with a threshold of %d got %q", test.input, test.threshold, line)
+		}
+	}
+}
+
+func TestPasteDetectionStopsAtEscape(t *testing.T) {
+	l := newTestEditor(t)
+	l.SetPasteDetectionThreshold(4)
+	// Left, then X, right behind the paste.
+	withInput(t, "abcdef\x1b[DX")
+	l.handleReadEvent()
+
+	if line := l.Line(); line != "abcdeXf" {
+		t.Errorf("got %q, want %q", line, "abcdeXf")
+	}
+}
+
+func TestResizeNarrower(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	_, _ = os.Stderr.WriteString("\x1b[2J\x1b[Hprevious output\r\n")
+	l.setOriginValue(2, 1)
+	l.refreshNeeded = true
+	feed(l, strings.Repeat("x", 120))
+
+	// What resized does, with the terminal reporting the cursor where it was left.
+	term.resize(40)
+	l.wasResized = true
+	l.previousNumColumns = l.numColumns
+	l.numColumns = 40
+	l.suggestionDisplay.setVTSize(l.numLines, l.numColumns)
+	row, column := term.cursor()
+	l.setOriginValue(uint32(row), uint32(column))
+	l.handleResizeEvent(false)
+
+	want := "previous output\n> " + strings.Repeat("x", 38) + "\n" + strings.Repeat("x", 40) + "\n" + strings.Repeat("x", 40) + "\nxx"
+	if screen := term.String(); screen != want {
+		t.Errorf("screen after resizing is\n%s\nwant\n%s", screen, want)
+	}
+	if row, column := term.cursor(); row != 5 || column != 3 {
+		t.Errorf("cursor at %d,%d, want 5,3", row, column)
+	}
+}
+
+func TestCompleteQuotedToken(t *testing.T) {
+	tests := []struct {
+		typed      string
+		completion string
+		want       string
+	}{
+		{"cat my", "my file", `cat my\ file`},
+		{`cat my\ f`, "my file", `cat my\ file`},
+		{`cat "my f`, "my file", `cat "my file"`},
+		{`cat 'it`, "it's", `cat 'it'\''s'`},
+		{"cat x", "my file", `cat my\ file`},
+		{"echo $PATH:/us", "/usr", `echo $PATH:/usr`},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.SetTokenizer(ShellTokenizer(":"))
+		l.SetTabCompletionHandler(func(_ Editor) []Completion {
+			return []Completion{{Text: test.completion, AllowCommitWithoutListing: true}}
+		})
+		feed(l, test.typed+"\t")
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("completing %q to %q got %q, want %q", test.typed, test.completion, line, test.want)
+		}
+	}
+}
+
+func BenchmarkRefreshMaskedSpans(b *testing.B) {
+	l := newTestEditor(b)
+	mask := NewMask("*", MaskModeReplaceEachCodePointInSelection)
+	l.SetRefreshHandler(func(editor Editor) {
+		// The same spans over and over, without stripping the styles first.
+		for i := uint32(0); i < 40; i += 4 {
+			editor.Stylize(Span{i, i + 2, SpanModeRune}, Style{Bold: true, Mask: mask})
+		}
+	})
+	l.InsertString(strings.Repeat("abcd", 10))
+
+	refresh := func() {
+		l.refreshNeeded = true
+		l.refreshDisplay()
+	}
+	// A long session's worth of refreshes, the masks mustn't pile up.
+	for i := 0; i < 10000; i++ {
+		refresh()
+	}
+	if len(l.currentMasks) == 0 || len(l.currentMasks) > 20 {
+		b.Fatalf("%d mask entries for 10 masked spans", len(l.currentMasks))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		refresh()
+	}
+}
+
+func TestCarriageReturnMetrics(t *testing.T) {
+	tests := []struct {
+		text string
+		want []uint32
+	}{
+		{"abc\rX", []uint32{3}},
+		{"abc\rXYZW", []uint32{4}},
+		{"abc\r\rX\rYZ", []uint32{3}},
+		{"abc\rX\nde\rfgh", []uint32{3, 3}},
+	}
+	l := NewEditor().(*lineEditor)
+	for _, test := range tests {
+		metrics := l.ActualRenderedStringMetrics(test.text)
+		var lengths []uint32
+		for _, line := range metrics.LineMetrics {
+			lengths = append(lengths, line.Length)
+		}
+		if !reflect.DeepEqual(lengths, test.want) {
+			t.Errorf("%q measured as lines of %v, want %v", test.text, lengths, test.want)
+		}
+	}
+}
+
+func TestCycleMixedOffsets(t *testing.T) {
+	l := newTestEditor(t)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{
+			{Text: "xyz", StaticOffset: 2},
+			{Text: "abcd", InvariantOffset: 2},
+		}
+	})
+	feed(l, "ab\t")
+
+	// The first tab only lists them, the rest go through them in turn.
+	for _, want := range []string{"xyz", "abcd", "xyz", "abcd"} {
+		feed(l, "\t")
+		if line := l.Line(); line != want {
+			t.Fatalf("cycled to %q, want %q", line, want)
+		}
+	}
+}
+
+func TestOneColumnTerminal(t *testing.T) {
+	term := newTestTerminal(t, 24, 1)
+	l := newTestEditorOn(t, term)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{{Text: "abcd", InvariantOffset: 3}, {Text: "abce", InvariantOffset: 3}}
+	})
+	// Typed a character per row, then the first suggestion put in by the second tab.
+	feed(l, "abc\t\t")
+
+	if line := l.Line(); line != "abcd" {
+		t.Errorf("line is %q, want %q", line, "abcd")
+	}
+	// The suggestions are listed one after the other, a character per row.
+	if screen := term.String(); !strings.HasSuffix(screen, "a\nb\nc\nd\na\nb\nc\ne") {
+		t.Errorf("screen is %q", screen)
+	}
+}
+
+func TestCompleteEmptyToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		completions []Completion
+		input       string
+		want        string
+	}{
+		{"listed", []Completion{{Text: "a.txt"}, {Text: "b.txt"}}, "ls \t\t", "ls a.txt"},
+		{"cycled", []Completion{{Text: "a.txt"}, {Text: "b.txt"}}, "ls \t\t\t", "ls b.txt"},
+		{"committed", []Completion{{Text: "a.txt"}, {Text: "b.txt"}}, "ls \t\t\t\t ", "ls a.txt "},
+		{"single", []Completion{{Text: "é.txt", AllowCommitWithoutListing: true}}, "ls \t", "ls é.txt"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.SetTabCompletionHandler(func(_ Editor) []Completion { return test.completions })
+		feed(l, test.input)
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("%s: line is %q, want %q", test.name, line, test.want)
+		}
+	}
+}
+
+func TestDeleteEncodings(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence string
+		want     string
+	}{
+		{"Delete", "\x1b[3~", "foo ar baz"},
+		{"Shift-Delete", "\x1b[3;2~", "foo ar baz"},
+		{"Alt-Delete", "\x1b[3;3~", "foo  baz"},
+		{"Ctrl-Delete", "\x1b[3;5~", "foo  baz"},
+		{"Ctrl-Delete (rxvt)", "\x1b[3^", "foo  baz"},
+		{"Alt-Backspace (CSI u)", "\x1b[127;3u", "bar baz"},
+		{"Ctrl-Backspace (CSI u)", "\x1b[127;5u", "bar baz"},
+		{"Ctrl-Backspace as ^H (CSI u)", "\x1b[8;5u", "bar baz"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		feed(l, "foo bar baz")
+		l.cursor = 4
+		feed(l, test.sequence)
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("%s (%q) left %q, want %q", test.name, test.sequence, line, test.want)
+		}
+	}
+}
+
+func TestOSCIsZeroWidth(t *testing.T) {
+	tests := []struct {
+		text string
+		want uint32
+	}{
+		{"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\> ", 6},
+		{"\x1b]8;;https://example.com\alink\x1b]8;;\a> ", 6},
+		{"\x1b]2;title\a> ", 2},
+		{"\x1b]0;title\x1b\\> ", 2},
+	}
+	l := NewEditor().(*lineEditor)
+	for _, test := range tests {
+		if metrics := l.ActualRenderedStringMetrics(test.text); metrics.LineMetrics[0].Length != test.want {
+			t.Errorf("%q measured as %d columns, want %d", test.text, metrics.LineMetrics[0].Length, test.want)
+		}
+	}
+
+	// And the cursor goes right after what's typed.
+	term := newTestTerminal(t, 24, 80)
+	l = newTestEditorOn(t, term)
+	l.SetPrompt(tests[0].text)
+	l.refreshNeeded = true
+	l.refreshDisplay()
+	feed(l, "a")
+	if row, column := term.cursor(); row != 1 || column != 8 {
+		t.Errorf("cursor at %d,%d after %q, want 1,8", row, column, term.line(1))
+	}
+}
+
+func TestCSIIsZeroWidth(t *testing.T) {
+	tests := []struct {
+		text string
+		want uint32
+	}{
+		{"\x1b[m> ", 2},
+		{"\x1b[?25l> \x1b[?25h", 2},
+		{"\x1b[1;31mred\x1b[0m> ", 5},
+		{"\x1b[2 q> ", 2},
+	}
+	l := NewEditor().(*lineEditor)
+	for _, test := range tests {
+		if metrics := l.ActualRenderedStringMetrics(test.text); metrics.LineMetrics[0].Length != test.want {
+			t.Errorf("%q measured as %d columns, want %d", test.text, metrics.LineMetrics[0].Length, test.want)
+		}
+	}
+}
+
+func TestInsertWideCharacter(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor uint32
+		want   string
+	}{
+		// One column short of the end of the row, so it goes on the next one.
+		{"end", 7, "> abcdefg\n中"},
+		{"middle", 2, "> ab中cdef\ng"},
+	}
+	for _, test := range tests {
+		term := newTestTerminal(t, 24, 10)
+		l := newTestEditorOn(t, term)
+		feed(l, "abcdefg")
+		l.cursor = test.cursor
+		feed(l, "中")
+
+		if screen := term.String(); screen != test.want {
+			t.Errorf("%s: screen is %q, want %q", test.name, screen, test.want)
+		}
+	}
+}
+
+func TestCompleteMultilineSnippet(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{{Text: "for {\n  x\n}", InvariantOffset: 2, AllowCommitWithoutListing: true}}
+	})
+	feed(l, "fo\t")
+
+	if line := l.Line(); line != "for {\n  x\n}" {
+		t.Errorf("line is %q", line)
+	}
+	if l.cursor != uint32(len(l.buffer)) {
+		t.Errorf("cursor at %d, want it after the snippet at %d", l.cursor, len(l.buffer))
+	}
+	if screen := term.String(); screen != "> for {\n  x\n}" {
+		t.Errorf("screen is %q", screen)
+	}
+	if row, column := term.cursor(); row != 3 || column != 2 {
+		t.Errorf("cursor at %d,%d, want 3,2", row, column)
+	}
+}
+
+func TestDisabledTerminalSpecialCharacters(t *testing.T) {
+	l := NewEditor().(*lineEditor)
+	l.termios.Cc[unix.VWERASE] = 0
+	l.termios.Cc[unix.VKILL] = 0xff
+	l.termios.Cc[unix.VERASE] = 0x7f
+	l.setDefaultKeybinds()
+
+	bound := map[uint32]int{}
+	for _, binding := range l.defaultKeybindings {
+		if len(binding.keys) == 1 && binding.keys[0].modifiers == 0 {
+			bound[binding.keys[0].key]++
+		}
+	}
+	// ^@ sets the mark, and that's all it does.
+	if bound[0] != 1 || bound[0xff] != 0 || bound[0x7f] != 1 {
+		t.Errorf("^@ bound %d times, 0xff %d times and ^? %d times", bound[0], bound[0xff], bound[0x7f])
+	}
+
+	l = newTestEditor(t)
+	l.termios.Cc[unix.VWERASE] = 0
+	l.setDefaultKeybinds()
+	feed(l, "foo bar\x00")
+	if line := l.Line(); line != "foo bar" {
+		t.Errorf("^@ left %q", line)
+	}
+}
+
+func TestEscapeClosesSuggestions(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{{Text: "foobar", InvariantOffset: 2}, {Text: "foobaz", InvariantOffset: 2}}
+	})
+	feed(l, "fo\t")
+	if !l.IsShowingCompletions() {
+		t.Fatal("tab didn't list the suggestions")
+	}
+
+	feed(l, "\x1b")
+	if l.IsShowingCompletions() || l.timesTabPressed != 0 {
+		t.Error("escape didn't close the suggestions")
+	}
+	if line := l.Line(); line != "fo" {
+		t.Errorf("line is %q, want %q", line, "fo")
+	}
+	if screen := term.String(); screen != "> fo" {
+		t.Errorf("screen is %q", screen)
+	}
+	if l.state != inputStateFree {
+		t.Error("escape was taken for the start of a sequence")
+	}
+}
+
+func TestInsertInvalidRune(t *testing.T) {
+	l := newTestEditor(t)
+	feed(l, "a")
+	l.InsertChar(0xd800)
+	l.InsertChar(0x110000)
+	feed(l, "b")
+
+	if line := l.Line(); line != "a\ufffd\ufffdb" {
+		t.Errorf("line is %q", line)
+	}
+	// Bytes 1 to 7 are the two replacement characters, and code points 1 to 3.
+	if start, end := l.byteOffsetRangeToCodePointOffsetRange(1, 7, 0, false); start != 1 || end != 3 {
+		t.Errorf("bytes 1 to 7 are code points %d to %d, want 1 to 3", start, end)
+	}
+}
+
+func BenchmarkInsertStringMidLine(b *testing.B) {
+	l := NewEditor().(*lineEditor)
+	text := strings.Repeat("pasted text ", 1000)
+	line := strings.Repeat("x", 1000)
+
+	for i := 0; i < b.N; i++ {
+		l.buffer = append(l.buffer[:0], []rune(line)...)
+		l.cursor = 500
+		l.InsertString(text)
+	}
+}
+
+func TestDeleteNewlines(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	l.InsertString("a\nb\nc\nd")
+	l.refreshDisplay()
+	if screen := term.String(); screen != "> a\nb\nc\nd" {
+		t.Fatalf("screen is %q", screen)
+	}
+
+	// Delete each newline in turn, all before the next refresh.
+	l.cursor = 1
+	feed(l, "\x1b[3~\x1b[C\x1b[3~\x1b[C\x1b[3~")
+	if line := l.Line(); line != "abcd" {
+		t.Fatalf("line is %q", line)
+	}
+	if screen := term.String(); screen != "> abcd" {
+		t.Errorf("screen is %q", screen)
+	}
+
+	// And once more, a refresh at a time.
+	l.InsertString("\n\n")
+	l.refreshDisplay()
+	feed(l, "\x7f")
+	feed(l, "\x7f")
+	if screen := term.String(); screen != "> abcd" {
+		t.Errorf("screen is %q", screen)
+	}
+}
+
+func TestAdjacentMasks(t *testing.T) {
+	each := NewMask("*", MaskModeReplaceEachCodePointInSelection)
+	entire := NewMask("[hidden]", MaskModeReplaceEntireSelection)
+	tests := []struct {
+		name          string
+		first, second *Mask
+		want          string
+	}{
+		{"each then entire", each, entire, "> ***[hidden]"},
+		{"entire then each", entire, each, "> [hidden]***"},
+	}
+	for _, test := range tests {
+		term := newTestTerminal(t, 24, 80)
+		l := newTestEditorOn(t, term)
+		first, second := test.first, test.second
+		l.SetRefreshHandler(func(editor Editor) {
+			editor.StripStyles()
+			editor.Stylize(Span{0, 3, SpanModeRune}, Style{Mask: first})
+			editor.Stylize(Span{3, 6, SpanModeRune}, Style{Mask: second})
+		})
+		feed(l, "abcdef")
+
+		if screen := term.String(); screen != test.want {
+			t.Errorf("%s: screen is %q, want %q", test.name, screen, test.want)
+		}
+		if row, column := term.cursor(); row != 1 || column != len(test.want)+1 {
+			t.Errorf("%s: cursor at %d,%d, want 1,%d", test.name, row, column, len(test.want)+1)
+		}
+		if metrics := l.bufferMetrics(uint32(len(l.buffer))); metrics.LineMetrics[0].Length != 11 {
+			t.Errorf("%s: measured as %d columns, want 11", test.name, metrics.LineMetrics[0].Length)
+		}
+	}
+}
+
+func TestRevealMasks(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	mask := NewMask("*", MaskModeReplaceEachCodePointInSelection)
+	l.SetRefreshHandler(func(editor Editor) {
+		editor.StripStyles()
+		editor.Stylize(Span{0, uint32(len(editor.Line())), SpanModeRune}, Style{Mask: mask})
+	})
+	feed(l, "hunter2")
+
+	// Alt-M toggles it.
+	for _, want := range []string{"> *******", "> hunter2", "> *******"} {
+		if screen := term.String(); screen != want {
+			t.Errorf("screen is %q, want %q", screen, want)
+		}
+		feed(l, "\x1bm")
+	}
+	if line := l.Line(); line != "hunter2" {
+		t.Errorf("line is %q", line)
+	}
+}
+
+func TestGetLineEndsWithReset(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	withInput(t, "abc\n")
+	l := NewEditor().(*lineEditor)
+	withoutCursorPositionReports(t)
+	l.SetRefreshHandler(func(editor Editor) {
+		editor.StripStyles()
+		editor.Stylize(Span{0, uint32(len(editor.Line())), SpanModeRune}, Style{Bold: true, ForegroundColor: MakeXtermColor(XtermColorRed)})
+	})
+	if _, err := l.GetLine("> "); err != nil {
+		t.Fatal(err)
+	}
+
+	// The line is left styled, but whatever is written after it isn't.
+	output := term.update()
+	end := output[strings.LastIndex(output, "abc"):]
+	reset := strings.LastIndex(end, "\x1b[22;24;23m\x1b[39m\x1b[49m")
+	if reset < 0 || !strings.Contains(end[reset:], "\r\n") || strings.Contains(end[reset:], "\x1b[1;") {
+		t.Errorf("no reset before leaving the line, output ends in %q", end)
+	}
+}
+
+func TestPartialCodePointAfterMultibyte(t *testing.T) {
+	l := newTestEditor(t)
+	// A whole é and a half, the rest of which comes with the next read.
+	feed(l, "\u00e9\xc3")
+	if string(l.incompleteData) != "\xc3" {
+		t.Errorf("%q left over, want the first byte of the next code point", l.incompleteData)
+	}
+	feed(l, "\xa9!")
+
+	if line := l.Line(); line != "\u00e9\u00e9!" {
+		t.Errorf("line is %q", line)
+	}
+}
+
+func TestWrapIndentAtBoundary(t *testing.T) {
+	term := newTestTerminal(t, 24, 10)
+	l := newTestEditorOn(t, term)
+	l.SetWrapIndent(2)
+
+	steps := []struct {
+		input       string
+		screen      string
+		row, column int
+	}{
+		// Right up to the edge, the cursor goes after the indent on the next row.
+		{"abcdefgh", "> abcdefgh", 2, 3},
+		{"i", "> abcdefgh\n  i", 2, 4},
+		{"jklmnopq", "> abcdefgh\n  ijklmnop\n  q", 3, 4},
+		{"\x7f", "> abcdefgh\n  ijklmnop", 3, 3},
+	}
+	for _, step := range steps {
+		feed(l, step.input)
+		if screen := term.String(); screen != step.screen {
+			t.Errorf("after %q, screen is %q, want %q", step.input, screen, step.screen)
+		}
+		if row, column := term.cursor(); row != step.row || column != step.column {
+			t.Errorf("after %q, cursor at %d,%d, want %d,%d", step.input, row, column, step.row, step.column)
+		}
+	}
+}
+
+func TestRenderStyled(t *testing.T) {
+	const (
+		boldRed   = "\x1b[1;24;23m\x1b[31m\x1b]8;;\x1b\\"
+		reset     = "\x1b[22;24;23m\x1b[39m\x1b[49m\x1b]8;;\x1b\\"
+		endOfLink = "\x1b]8;;\x1b\\"
+	)
+	l := NewEditor().(*lineEditor)
+	l.SetPrompt("> ")
+	l.InsertString("foo bar")
+	l.Stylize(Span{0, 3, SpanModeRune}, Style{Bold: true, ForegroundColor: MakeXtermColor(XtermColorRed)})
+
+	want := boldRed + "foo" + endOfLink + reset + " bar" + reset
+	if rendered := l.RenderStyled(false); rendered != want {
+		t.Errorf("rendered %q, want %q", rendered, want)
+	}
+	if rendered := l.RenderStyled(true); rendered != "> "+want {
+		t.Errorf("rendered %q with the prompt, want %q", rendered, "> "+want)
+	}
+
+	l.Stylize(Span{4, 7, SpanModeRune}, Style{Mask: NewMask("*", MaskModeReplaceEachCodePointInSelection)})
+	want = boldRed + "foo" + endOfLink + reset + " \x1b[22;24;23m" + endOfLink + "***" + reset
+	if rendered := l.RenderStyled(false); rendered != want {
+		t.Errorf("rendered %q with a mask, want %q", rendered, want)
+	}
+}
+
+func TestSingleCompletion(t *testing.T) {
+	tests := []struct {
+		name       string
+		autoCommit bool
+		input      string
+		want       string
+		completing bool
+	}{
+		{"auto-committed", true, "fo\t", "foobar ", false},
+		{"previewed", false, "fo\t", "foobar", true},
+		{"confirmed", false, "fo\t\t", "foobar ", false},
+		{"typed over", false, "fo\tx", "foobarx", false},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.SetAutoCommitSingleCompletion(test.autoCommit)
+		l.SetTabCompletionHandler(func(_ Editor) []Completion {
+			return []Completion{{Text: "foobar", TrailingTrivia: " ", InvariantOffset: 2, AllowCommitWithoutListing: true}}
+		})
+		feed(l, test.input)
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("%s: line is %q, want %q", test.name, line, test.want)
+		}
+		if completing := l.timesTabPressed != 0; completing != test.completing {
+			t.Errorf("%s: still completing is %v, want %v", test.name, completing, test.completing)
+		}
+	}
+}
+
+func TestCycleAfterCompletedPrefix(t *testing.T) {
+	l := newTestEditor(t)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{{Text: "foobar", InvariantOffset: 2, AllowCommitWithoutListing: true}, {Text: "foobaz", InvariantOffset: 2, AllowCommitWithoutListing: true}}
+	})
+
+	// The first tab puts in the common prefix, the ones after it go through the suggestions past what was typed.
+	for _, step := range []struct{ input, want string }{{"fo\t", "fooba"}, {"\t", "foobar"}, {"\t", "foobaz"}} {
+		feed(l, step.input)
+		if line := l.Line(); line != step.want {
+			t.Fatalf("after %q: line is %q, want %q", step.input, line, step.want)
+		}
+	}
+}
+
+func TestCompletionAppendSpace(t *testing.T) {
+	tests := []struct {
+		name        string
+		appendSpace bool
+		completions []Completion
+		input       string
+		want        string
+	}{
+		{"single, with trivia", true, []Completion{{Text: "dir/", TrailingTrivia: " "}}, "d\t", "dir/ "},
+		{"single, without trivia", false, []Completion{{Text: "dir/", TrailingTrivia: " "}}, "d\t", "dir/"},
+		{"cycled, with trivia", true, []Completion{{Text: "dir/", TrailingTrivia: " "}, {Text: "doc/", TrailingTrivia: " "}}, "d\t\t", "dir/ "},
+		{"cycled, without trivia", false, []Completion{{Text: "dir/", TrailingTrivia: " "}, {Text: "doc/", TrailingTrivia: " "}}, "d\t\t", "dir/"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.SetCompletionAppendSpace(test.appendSpace)
+		l.SetTabCompletionHandler(func(_ Editor) []Completion {
+			completions := append([]Completion(nil), test.completions...)
+			for i := range completions {
+				completions[i].InvariantOffset = 1
+				completions[i].AllowCommitWithoutListing = len(completions) == 1
+			}
+			return completions
+		})
+		feed(l, test.input)
+		// Typing on is what commits a suggestion that's being cycled through.
+		feed(l, "x")
+
+		if line := l.Line(); line != test.want+"x" {
+			t.Errorf("%s: line is %q, want %q", test.name, line, test.want+"x")
+		}
+	}
+}
+
+func TestRedrawFromRefreshHandler(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	calls := 0
+	l.SetRefreshHandler(func(editor Editor) {
+		calls++
+		editor.SetPrompt(strings.Repeat("$", len(editor.Line())) + " ")
+		editor.Redraw()
+	})
+	feed(l, "a")
+	feed(l, "bc")
+
+	if screen := term.String(); screen != "$$$ abc" {
+		t.Errorf("screen is %q", screen)
+	}
+	if row, column := term.cursor(); row != 1 || column != 8 {
+		t.Errorf("cursor at %d,%d, want 1,8", row, column)
+	}
+	if calls > 4 {
+		t.Errorf("the handler was called %d times for two refreshes", calls)
+	}
+}
+
+func TestRedrawInPlace(t *testing.T) {
+	tests := []struct {
+		name string
+		// What else happens to the screen before the redraw, and what the terminal says about the cursor after.
+		meanwhile, report string
+		want              string
+		row               int
+	}{
+		{"untouched", "", "\x1b[1;6R", "> hello", 1},
+		{"moved down a line", "\x1b[Hnoise\x1b[K\r\n> hello\x1b[2;6H", "\x1b[2;6R", "noise\n> hello", 2},
+	}
+	for _, test := range tests {
+		term := newTestTerminal(t, 24, 80)
+		l := newTestEditorOn(t, term)
+		feed(l, "hello\x1b[D\x1b[D")
+		os.Stderr.WriteString(test.meanwhile)
+
+		withReply(t, test.report)
+		l.noCursorPositionReports = false
+		l.Redraw()
+
+		if screen := term.String(); screen != test.want {
+			t.Errorf("%s: screen is %q, want %q", test.name, screen, test.want)
+		}
+		if row, column := term.cursor(); row != test.row || column != 6 {
+			t.Errorf("%s: cursor at %d,%d, want %d,6", test.name, row, column, test.row)
+		}
+	}
+}
+
+func TestUnknownCSIIsQuiet(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	var ignored []string
+	l.SetInputLogger(func(raw []byte, decoded string) {
+		if strings.HasSuffix(decoded, ", ignored") {
+			ignored = append(ignored, string(raw))
+		}
+	})
+	feed(l, "ab")
+	term.update()
+
+	// A device attributes reply, an unknown final, an unknown ~ key and an unknown CSI u key.
+	sequences := []string{"\x1b[?62;22c", "\x1b[5;7z", "\x1b[99~", "\x1b[5u"}
+	for _, sequence := range sequences {
+		feed(l, sequence)
+	}
+
+	// Nothing but putting the cursor back where it was.
+	if written := term.update(); strings.ReplaceAll(written, "\x1b[1;5H", "") != "" {
+		t.Errorf("unknown sequences had %q written out", written)
+	}
+	if screen := term.String(); screen != "> ab" {
+		t.Errorf("screen is %q", screen)
+	}
+	if line := l.Line(); line != "ab" {
+		t.Errorf("line is %q", line)
+	}
+	if !reflect.DeepEqual(ignored, sequences) {
+		t.Errorf("the input logger was told of %q being ignored, want %q", ignored, sequences)
+	}
+}
+
+func TestRawSequenceAcrossReads(t *testing.T) {
+	tests := []struct {
+		name        string
+		typed, rest string
+		want        []string
+		line        string
+	}{
+		{"cut short", "\x1b[9", "9;9~", []string{"\x1b[99;9~"}, ""},
+		{"longest match", "\x1bx", "y", []string{"\x1bxy"}, ""},
+		{"nothing more coming", "\x1bx", "", []string{"\x1bx"}, ""},
+		{"something else coming", "\x1bx", "a", []string{"\x1bx"}, "a"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		var got []string
+		for _, sequence := range []string{"\x1b[99;9~", "\x1bx", "\x1bxy"} {
+			l.RegisterRawSequence([]byte(sequence), func(sequence []byte, _ Editor) {
+				got = append(got, string(sequence))
+			})
+		}
+		withInput(t, test.rest)
+		feed(l, test.typed)
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: matched %q, want %q", test.name, got, test.want)
+		}
+		if line := l.Line(); line != test.line {
+			t.Errorf("%s: line is %q, want %q", test.name, line, test.line)
+		}
+	}
+}
+
+func TestCursorPositionReportTimeout(t *testing.T) {
+	l := newTestEditor(t)
+	l.setOriginValue(5, 3)
+	l.noCursorPositionReports = false
+	withoutCursorPositionReports(t)
+	// Something comes in, just not in time.
+	withReply(t, "\x1b[6;1R")
+
+	l.setOrigin(false)
+	if l.originRow != 5 || l.originColumn != 1 {
+		t.Errorf("origin is %d,%d after the terminal didn't answer, want 5,1", l.originRow, l.originColumn)
+	}
+	if !l.noCursorPositionReports {
+		t.Error("asking again after the terminal didn't answer")
+	}
+}
+
+func TestCursorPositionReportRetriedOnGetLine(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := NewEditor().(*lineEditor)
+	// The last line's report didn't come in time.
+	l.noCursorPositionReports = true
+	withReply(t, "\x1b[7;3Rabc\n")
+
+	line, err := l.GetLine("> ")
+	if err != nil || line != "abc" {
+		t.Fatalf("GetLine returned %q, %v", line, err)
+	}
+	if drawn := term.line(7); drawn != "  > abc" {
+		t.Errorf("row 7 is %q, the line wasn't drawn where the terminal said", drawn)
+	}
+}
+
+func TestLateCursorPositionReport(t *testing.T) {
+	l := newTestEditor(t)
+	var ignored []string
+	l.SetInputLogger(func(raw []byte, decoded string) {
+		if strings.HasSuffix(decoded, ", ignored") {
+			ignored = append(ignored, decoded)
+		}
+	})
+	feed(l, "ab\x1b[12;40Rc")
+
+	if line := l.Line(); line != "abc" {
+		t.Errorf("line is %q", line)
+	}
+	if !reflect.DeepEqual(ignored, []string{"late cursor position report, ignored"}) {
+		t.Errorf("ignored %q", ignored)
+	}
+}
+
+func TestPromptAsWideAsTheTerminal(t *testing.T) {
+	const columns = 20
+	tests := []struct {
+		promptWidth int
+		// What the prompt and "ab" after it take up, and where the cursor ends up in there.
+		rows   []string
+		column int
+	}{
+		{columns - 1, []string{strings.Repeat("#", columns-1) + "a", "b"}, 2},
+		{columns, []string{strings.Repeat("#", columns), "ab"}, 3},
+		{columns + 1, []string{strings.Repeat("#", columns), "#ab"}, 4},
+		{2 * columns, []string{strings.Repeat("#", columns), strings.Repeat("#", columns), "ab"}, 3},
+	}
+	for _, test := range tests {
+		// At the top, and on the last row, where the terminal has to scroll to make room.
+		for _, row := range []int{1, 10} {
+			term := newTestTerminal(t, 10, columns)
+			l := newTestEditorOn(t, term)
+			os.Stderr.WriteString("\x1b[H\x1b[2J")
+			l.setOriginValue(uint32(row), 1)
+			l.SetPrompt(strings.Repeat("#", test.promptWidth))
+			l.refreshDisplay()
+			feed(l, "ab")
+
+			origin := minInt(row, 10-len(test.rows)+1)
+			want := strings.Repeat("\n", origin-1) + strings.Join(test.rows, "\n")
+			if screen := term.String(); screen != want {
+				t.Errorf("%d wide prompt on row %d: screen is %q, want %q", test.promptWidth, row, screen, want)
+			}
+			if int(l.originRow) != origin || l.originColumn != 1 {
+				t.Errorf("%d wide prompt on row %d: origin is %d,%d, want %d,1", test.promptWidth, row, l.originRow, l.originColumn, origin)
+			}
+			wantRow := origin + len(test.rows) - 1
+			if cursorRow, cursorColumn := term.cursor(); cursorRow != wantRow || cursorColumn != test.column {
+				t.Errorf("%d wide prompt on row %d: cursor at %d,%d, want %d,%d", test.promptWidth, row, cursorRow, cursorColumn, wantRow, test.column)
+			}
+		}
+	}
+}
+
+func TestSuspendAndRunWhileNotEditing(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := NewEditor().(*lineEditor)
+	l.noCursorPositionReports = true
+
+	ran := false
+	err := l.SuspendAndRun(func() error {
+		ran = true
+		return nil
+	})
+	if err != nil || !ran {
+		t.Fatalf("SuspendAndRun returned %v, ran fn: %v", err, ran)
+	}
+	if written := term.update(); written != "" {
+		t.Errorf("wrote %q with no line being edited, want nothing", written)
+	}
+}
+
+func TestEscapeSequenceSplitAcrossReadsWithSuggestions(t *testing.T) {
+	l := newTestEditor(t)
+	l.SetTabCompletionHandler(func(_ Editor) []Completion {
+		return []Completion{{Text: "foobar", InvariantOffset: 2}, {Text: "foobaz", InvariantOffset: 2}}
+	})
+	feed(l, "fo\t")
+	if !l.IsShowingCompletions() {
+		t.Fatal("tab didn't list the suggestions")
+	}
+
+	// The rest of the up arrow only comes with the next read.
+	withInput(t, "[A")
+	feed(l, "\x1b")
+	// Whatever wasn't read yet gets to the editor after all, as it would in GetLine.
+	l.readPendingInput()
+	feed(l, "")
+	// Which is what the up arrow in one read leaves too.
+	if line := l.Line(); line != "fo" {
+		t.Errorf("line is %q, want %q", line, "fo")
+	}
+	if l.state != inputStateFree {
+		t.Error("the up arrow wasn't handled")
+	}
+}
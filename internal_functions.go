@@ -3,6 +3,7 @@ package line
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"strings"
 	"syscall"
 	"unicode"
@@ -19,9 +20,19 @@ func finish(editor *lineEditor) {
 	editor.Finish()
 }
 
+// operateAndGetNext finishes the line like finish, and if it came from the history,
+// has the next GetLine start out with the entry after it.
+func operateAndGetNext(editor *lineEditor) {
+	if editor.hasHistoryIndex && editor.historyIndex+1 < uint32(len(editor.history)) {
+		editor.nextHistoryIndex = editor.historyIndex + 1
+		editor.hasNextHistoryIndex = true
+	}
+	editor.Finish()
+}
+
 func finishEdit(editor *lineEditor) {
 	fmt.Fprintf(os.Stdout, "<EOF>\n")
-	if !editor.alwaysRefresh {
+	if !editor.isSearchEditor {
 		editor.inputError = syscall.ECANCELED
 		editor.Finish()
 	}
@@ -50,20 +61,12 @@ func cursorLeftCharacter(editor *lineEditor) {
 	editor.inlineSearchCursor = editor.cursor
 }
 func cursorRightWord(editor *lineEditor) {
-	if editor.cursor < uint32(len(editor.buffer)) {
-		// Temporarily put a space at the end of the our buffer,
-		// doing this greatly simplifies the logic below.
-		editor.buffer = append(editor.buffer, ' ')
-		for {
-			if editor.cursor >= uint32(len(editor.buffer)) {
-				break
-			}
-			editor.cursor++
-			if !isAlphaNumeric(editor.buffer[editor.cursor]) {
-				break
-			}
+	// Past the end of the buffer counts as a space, so the last word ends there.
+	for editor.cursor < uint32(len(editor.buffer)) {
+		editor.cursor++
+		if editor.cursor == uint32(len(editor.buffer)) || !isAlphaNumeric(editor.buffer[editor.cursor]) {
+			break
 		}
-		editor.buffer = editor.buffer[:len(editor.buffer)-1]
 	}
 	editor.inlineSearchCursor = editor.cursor
 	editor.searchOffset = 0
@@ -90,7 +93,7 @@ func eraseCharacterBackwards(editor *lineEditor) {
 		return
 	}
 	if editor.cursor == 0 {
-		os.Stderr.Write([]byte("\a"))
+		editor.ringBell()
 		return
 	}
 	editor.removeAtIndex(editor.cursor - 1)
@@ -100,12 +103,22 @@ func eraseCharacterBackwards(editor *lineEditor) {
 }
 func eraseCharacterForwards(editor *lineEditor) {
 	if editor.cursor == uint32(len(editor.buffer)) {
-		os.Stderr.Write([]byte("\a"))
+		editor.ringBell()
 		return
 	}
 	editor.removeAtIndex(editor.cursor)
 	editor.refreshNeeded = true
 }
+func eraseSelectionOrCharacterBackwards(editor *lineEditor) {
+	if !editor.DeleteSelection() {
+		eraseCharacterBackwards(editor)
+	}
+}
+func eraseSelectionOrCharacterForwards(editor *lineEditor) {
+	if !editor.DeleteSelection() {
+		eraseCharacterForwards(editor)
+	}
+}
 func eraseAlnumWordBackwards(editor *lineEditor) {
 	hasSeenAlnum := false
 	for editor.cursor > 0 {
@@ -153,6 +166,12 @@ func clearScreen(editor *lineEditor) {
 	editor.refreshNeeded = true
 	editor.cachedPromptValid = false
 }
+func redraw(editor *lineEditor) {
+	editor.Redraw()
+}
+func toggleRevealMasks(editor *lineEditor) {
+	editor.SetRevealMasks(!editor.revealMasks)
+}
 func searchForwards(editor *lineEditor) {
 	defer func(original uint32) {
 		editor.inlineSearchCursor = original
@@ -173,15 +192,50 @@ func searchForwards(editor *lineEditor) {
 			original = editor.searchOffset
 		} else {
 			editor.searchOffsetState = searchOffsetStateUnbiased
+			if editor.historyBoundary == HistoryBoundaryBeep {
+				editor.ringBell()
+			}
 		}
+	} else if editor.historyBoundary == HistoryBoundaryWrap && !editor.hasHistoryStash {
+		// Already on the line being edited, wrap around to the oldest entry.
+		if matches := editor.countHistoryPrefixMatches(searchPhrase); matches > 0 {
+			stashLineBeingEdited(editor)
+			editor.searchOffset = matches - 1
+			editor.search(searchPhrase, true, true)
+			editor.searchOffsetState = searchOffsetStateBackwards
+			editor.searchOffset = matches
+		}
+	} else if editor.hasHistoryStash {
+		returnToLineBeingEdited(editor, searchPhrase)
+	}
+	// Otherwise we're on the line being edited already, and there's nowhere further down to go.
+}
+
+// stashLineBeingEdited remembers the line being edited as history navigation starts, so it can be put back.
+func stashLineBeingEdited(editor *lineEditor) {
+	editor.historyStash = append(editor.historyStash[:0], editor.buffer...)
+	editor.historyStashCursor = editor.cursor
+	editor.hasHistoryStash = true
+}
+
+// returnToLineBeingEdited leaves the history for the line that was being edited before going into it.
+func returnToLineBeingEdited(editor *lineEditor, searchPhrase string) {
+	editor.searchOffset = 0
+	editor.searchOffsetState = searchOffsetStateUnbiased
+	editor.charsTouchedInTheMiddle = uint32(len(editor.buffer))
+	editor.markBufferChanged()
+	editor.cursor = 0
+	editor.buffer = editor.buffer[:0]
+	editor.hasHistoryIndex = false
+	if editor.hasHistoryStash {
+		// We've walked past the newest entry, give back whatever the user was typing.
+		editor.InsertString(string(editor.historyStash))
+		editor.cursor = editor.historyStashCursor
+		editor.hasHistoryStash = false
 	} else {
-		editor.searchOffsetState = searchOffsetStateUnbiased
-		editor.charsTouchedInTheMiddle = uint32(len(editor.buffer))
-		editor.cursor = 0
-		editor.buffer = editor.buffer[:0]
 		editor.InsertString(searchPhrase)
-		editor.refreshNeeded = true
 	}
+	editor.refreshNeeded = true
 }
 func searchBackwards(editor *lineEditor) {
 	defer func(original uint32) {
@@ -189,16 +243,103 @@ func searchBackwards(editor *lineEditor) {
 	}(editor.inlineSearchCursor)
 
 	searchPhrase := string(editor.buffer[:editor.inlineSearchCursor])
+	if editor.searchOffset == 0 && !editor.hasHistoryStash {
+		// History navigation is just starting, remember the line being edited so it can be restored.
+		stashLineBeingEdited(editor)
+	}
 	if editor.searchOffsetState == searchOffsetStateForwards {
 		editor.searchOffset++
 	}
 	if editor.search(searchPhrase, true, true) {
 		editor.searchOffsetState = searchOffsetStateBackwards
 		editor.searchOffset++
-	} else {
-		editor.searchOffsetState = searchOffsetStateUnbiased
+		return
+	}
+
+	editor.searchOffsetState = searchOffsetStateUnbiased
+	if editor.searchOffset > 0 {
 		editor.searchOffset--
 	}
+	switch editor.historyBoundary {
+	case HistoryBoundaryBeep:
+		editor.ringBell()
+	case HistoryBoundaryWrap:
+		if editor.searchOffset > 0 {
+			// Past the oldest entry, wrap around to the line being edited; from there, Up starts over with the newest.
+			returnToLineBeingEdited(editor, searchPhrase)
+		}
+	}
+}
+
+// columnWidth returns how wide the buffer between start and end is drawn, assuming it has no newlines.
+func (l *lineEditor) columnWidth(start, end uint32) uint32 {
+	metrics := l.ActualRenderedStringMetrics(string(l.buffer[start:end]))
+	return metrics.LineMetrics[len(metrics.LineMetrics)-1].Length
+}
+
+// moveCursorVertically moves the cursor to the previous or next line of a multiline buffer,
+// keeping it as close as possible to the column it was at when vertical movement started.
+// It returns false if there is no line to move to.
+func (l *lineEditor) moveCursorVertically(up bool) bool {
+	length := uint32(len(l.buffer))
+	lineStart := l.cursor
+	for lineStart > 0 && l.buffer[lineStart-1] != '\n' {
+		lineStart--
+	}
+
+	var targetStart, targetEnd uint32
+	if up {
+		if lineStart == 0 {
+			return false
+		}
+		targetEnd = lineStart - 1
+		targetStart = targetEnd
+		for targetStart > 0 && l.buffer[targetStart-1] != '\n' {
+			targetStart--
+		}
+	} else {
+		lineEnd := l.cursor
+		for lineEnd < length && l.buffer[lineEnd] != '\n' {
+			lineEnd++
+		}
+		if lineEnd == length {
+			return false
+		}
+		targetStart = lineEnd + 1
+		targetEnd = targetStart
+		for targetEnd < length && l.buffer[targetEnd] != '\n' {
+			targetEnd++
+		}
+	}
+
+	// Anything that moved the cursor since the last vertical motion resets the goal column.
+	if !l.hasGoalColumn || l.goalColumnCursor != l.cursor {
+		l.goalColumn = l.columnWidth(lineStart, l.cursor)
+	}
+
+	cursor := targetStart
+	for cursor < targetEnd && l.columnWidth(targetStart, cursor+1) <= l.goalColumn {
+		cursor++
+	}
+
+	l.cursor = cursor
+	l.inlineSearchCursor = cursor
+	l.goalColumnCursor = cursor
+	l.hasGoalColumn = true
+	return true
+}
+
+func cursorUpLineOrSearchBackwards(editor *lineEditor) {
+	if editor.multilineMode && editor.moveCursorVertically(true) {
+		return
+	}
+	searchBackwards(editor)
+}
+func cursorDownLineOrSearchForwards(editor *lineEditor) {
+	if editor.multilineMode && editor.moveCursorVertically(false) {
+		return
+	}
+	searchForwards(editor)
 }
 func eraseToEnd(editor *lineEditor) {
 	for editor.cursor < uint32(len(editor.buffer)) {
@@ -215,42 +356,54 @@ func enterSearch(editor *lineEditor) {
 	editor.preSearchBuffer = append(editor.preSearchBuffer[:0], editor.buffer...)
 	editor.preSearchCursor = editor.cursor
 
-	editor.ensureFreeLinesFromOrigin(editor.NumLines() + 1)
+	editor.ensureFreeLinesFromOrigin(os.Stderr, editor.NumLines()+1)
 
 	editor.searchEditor = NewEditor().(*lineEditor)
 	editor.searchEditor.enableSignalHandling = false
 	editor.searchEditor.alwaysRefresh = true
+	editor.searchEditor.isSearchEditor = true
+	// It's the same terminal, there's no point waiting on it for a cursor position it didn't report to us.
+	editor.searchEditor.noCursorPositionReports = editor.noCursorPositionReports
 	editor.searchEditor.Initialize()
 
-	editor.searchEditor.onRefresh = func(_ Editor) {
-		// Remove the search editor prompt before updating ourselves (this avoids artifacts when we move the search editor around).
-		editor.searchEditor.cleanup()
-
+	// Bring our buffer up to date with whatever's been typed in the search editor so far, ringing the bell
+	// for a phrase that isn't found if complain is set.
+	searchForPhrase := func(complain bool) {
 		searchPhrase := string(editor.searchEditor.buffer)
 		if !editor.search(searchPhrase, false, false) {
+			if complain && len(searchPhrase) > 0 {
+				editor.ringBell()
+			}
 			editor.charsTouchedInTheMiddle = uint32(len(editor.buffer))
 			editor.refreshNeeded = true
+			editor.markBufferChanged()
 			editor.buffer = editor.buffer[:0]
 			editor.cursor = 0
 		}
+	}
 
+	editor.searchEditor.onRefresh = func(_ Editor) {
+		// Remove the search editor prompt before updating ourselves (this avoids artifacts when we move the search editor around).
+		editor.searchEditor.cleanup()
+
+		searchForPhrase(true)
 		editor.refreshDisplay()
 
 		// Move the search prompt below ours and tell it to redraw itself.
-		promptEndLine := editor.CurrentPromptMetrics().LinesWithAddition(&editor.cachedBufferMetrics, editor.numColumns)
+		promptEndLine := editor.NumLines()
 		editor.searchEditor.setOriginValue(promptEndLine+editor.originRow, 1)
 		editor.searchEditor.refreshNeeded = true
 	}
 
 	// Whenever the search editor gets a ^R, cycle between history entries.
-	editor.searchEditor.RegisterKeybinding([]key{{key: ctrl('R')}}, func(_ []key, _ Editor) bool {
+	editor.searchEditor.RegisterKeybinding([]KeyPress{{key: ctrl('R')}}, func(_ []KeyPress, _ Editor) bool {
 		editor.searchOffset++
 		editor.searchEditor.refreshNeeded = true
 		return false // Don't process this key event
 	})
 
 	// ^C should cancel the search.
-	editor.searchEditor.RegisterKeybinding([]key{{key: ctrl('C')}}, func(_ []key, _ Editor) bool {
+	editor.searchEditor.RegisterKeybinding([]KeyPress{{key: ctrl('C')}}, func(_ []KeyPress, _ Editor) bool {
 		editor.searchEditor.Finish()
 		editor.resetBufferOnSearchEnd = true
 		editor.searchEditor.endSearch()
@@ -258,30 +411,36 @@ func enterSearch(editor *lineEditor) {
 		return false
 	})
 
-	// ^L - This is a source of issues, as the search editor refreshes first,
-	// and we end up with the wrong order of prompts, so we will first refresh
-	// ourselves, and then refresh the search editor, and tell it not to process
-	// this event.
-	editor.searchEditor.RegisterKeybinding([]key{{key: ctrl('L')}}, func(_ []key, _ Editor) bool {
-		// Clear screen
+	// ^L - Both prompts have to be redrawn, ours first and the search prompt below it; left to itself
+	// the search editor would refresh first and draw over whatever we draw after it. The screen is cleared
+	// with the cursor sent home, so there's no need to ask the terminal where things are: ours starts at the
+	// top, and the search prompt right below wherever ours ends up (which may have scrolled).
+	editor.searchEditor.RegisterKeybinding([]KeyPress{{key: ctrl('L')}}, func(_ []KeyPress, _ Editor) bool {
 		os.Stderr.Write([]byte("\x1b[3J\x1b[H\x1b[2J"))
 
-		// Refresh our own prompt
+		// Refresh our own prompt, with what the search phrase finds now; the search editor hasn't necessarily
+		// refreshed since it was last typed into. It's about to, and will complain about the phrase if need be.
+		searchForPhrase(false)
+		alwaysRefresh := editor.alwaysRefresh
 		editor.alwaysRefresh = true
 		editor.setOriginValue(1, 1)
+		editor.extraForwardLines = 0
+		editor.cachedPromptValid = false
 		editor.refreshNeeded = true
 		editor.refreshDisplay()
-		editor.alwaysRefresh = false
+		editor.alwaysRefresh = alwaysRefresh
 
-		// Move the search prompt below ours and tell it to redraw itself.
-		promptEndLine := editor.CurrentPromptMetrics().LinesWithAddition(&editor.cachedPromptMetrics, editor.numLines)
-		editor.searchEditor.setOriginValue(promptEndLine+editor.originRow, 1)
+		// Then the search prompt, below ours, right away rather than whenever the search editor gets to it.
+		editor.searchEditor.setOriginValue(editor.originRow+editor.NumLines(), 1)
+		editor.searchEditor.extraForwardLines = 0
+		editor.searchEditor.cachedPromptValid = false
 		editor.searchEditor.refreshNeeded = true
+		editor.searchEditor.refreshDisplay()
 		return false
 	})
 
 	// \t, Quit without clearing the curren buffer.
-	editor.searchEditor.RegisterKeybinding([]key{{key: '\t'}}, func(_ []key, _ Editor) bool {
+	editor.searchEditor.RegisterKeybinding([]KeyPress{{key: '\t'}}, func(_ []KeyPress, _ Editor) bool {
 		editor.searchEditor.Finish()
 		editor.resetBufferOnSearchEnd = false
 		return false
@@ -359,11 +518,56 @@ func transposeCharacters(editor *lineEditor) {
 		editor.buffer[editor.cursor-1] = editor.buffer[editor.cursor-2]
 		editor.buffer[editor.cursor-2] = t
 		editor.refreshNeeded = true
+		editor.markBufferChanged()
 		editor.charsTouchedInTheMiddle += 2
 	}
 }
 func editInExternalEditor(editor *lineEditor) {
-	panic("TODO!")
+	editorCommand := os.Getenv("VISUAL")
+	if editorCommand == "" {
+		editorCommand = os.Getenv("EDITOR")
+	}
+	if editorCommand == "" {
+		editorCommand = "vi"
+	}
+
+	f, err := os.CreateTemp("", "line-*.txt")
+	if err != nil {
+		editor.ringBell()
+		return
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(string(editor.buffer))
+	f.Close()
+	if err != nil {
+		editor.ringBell()
+		return
+	}
+
+	err = editor.SuspendAndRun(func() error {
+		// The variable is a command line, e.g. "code --wait", leave splitting it up to the shell.
+		cmd := exec.Command("sh", "-c", editorCommand+` "$1"`, "sh", f.Name())
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		editor.ringBell()
+		return
+	}
+
+	contents, err := os.ReadFile(f.Name())
+	if err != nil {
+		editor.ringBell()
+		return
+	}
+
+	// Most editors add a trailing newline, which would just submit the line.
+	editor.SetLine(strings.TrimRight(string(contents), "\n"))
+	editor.cursor = uint32(len(editor.buffer))
+	editor.inlineSearchCursor = editor.cursor
 }
 
 type caseChangeOp int
@@ -388,6 +592,7 @@ func caseChangeWord(editor *lineEditor, op caseChangeOp) {
 		}
 		editor.cursor++
 		editor.refreshNeeded = true
+		editor.markBufferChanged()
 	}
 }
 
@@ -408,6 +613,59 @@ func killLine(editor *lineEditor) {
 	editor.inlineSearchCursor = 0
 	editor.refreshNeeded = true
 }
+func setMark(editor *lineEditor) {
+	editor.mark = editor.cursor
+	editor.hasMark = true
+}
+
+// region returns the range between the cursor and the mark, if there's a mark.
+func (l *lineEditor) region() (start, end uint32, ok bool) {
+	if !l.hasMark {
+		return 0, 0, false
+	}
+	// Edits might have shrunk the buffer under the mark.
+	l.mark = min(l.mark, uint32(len(l.buffer)))
+	return min(l.mark, l.cursor), max(l.mark, l.cursor), true
+}
+
+func exchangePointAndMark(editor *lineEditor) {
+	if _, _, ok := editor.region(); !ok {
+		editor.ringBell()
+		return
+	}
+	editor.cursor, editor.mark = editor.mark, editor.cursor
+	editor.inlineSearchCursor = editor.cursor
+}
+func copyRegion(editor *lineEditor) {
+	start, end, ok := editor.region()
+	if !ok {
+		editor.ringBell()
+		return
+	}
+	editor.killBuffer = append(editor.killBuffer[:0], editor.buffer[start:end]...)
+}
+func killRegion(editor *lineEditor) {
+	start, end, ok := editor.region()
+	if !ok {
+		eraseWordBackwards(editor)
+		return
+	}
+	editor.killBuffer = append(editor.killBuffer[:0], editor.buffer[start:end]...)
+	for i := start; i < end; i++ {
+		editor.removeAtIndex(start)
+	}
+	editor.cursor = start
+	editor.inlineSearchCursor = editor.cursor
+	editor.hasMark = false
+	editor.refreshNeeded = true
+}
+func yank(editor *lineEditor) {
+	if len(editor.killBuffer) == 0 {
+		editor.ringBell()
+		return
+	}
+	editor.InsertString(string(editor.killBuffer))
+}
 func transposeWords(editor *lineEditor) {
 	panic("TODO!")
 }
@@ -422,3 +680,52 @@ func insertLastWords(editor *lineEditor) {
 		editor.InsertString(lastWords[len(lastWords)-1])
 	}
 }
+
+// actions are the internal functions by the names readline gives them, for configuration files to bind keys to.
+var actions = map[string]func(editor *lineEditor){
+	"accept-line":              finish,
+	"operate-and-get-next":     operateAndGetNext,
+	"end-of-file":              finishEdit,
+	"backward-char":            cursorLeftCharacter,
+	"forward-char":             cursorRightCharacter,
+	"backward-word":            cursorLeftWord,
+	"forward-word":             cursorRightWord,
+	"beginning-of-line":        goHome,
+	"end-of-line":              goEnd,
+	"previous-history":         cursorUpLineOrSearchBackwards,
+	"next-history":             cursorDownLineOrSearchForwards,
+	"history-search-backward":  searchBackwards,
+	"history-search-forward":   searchForwards,
+	"reverse-search-history":   enterSearch,
+	"backward-delete-char":     eraseSelectionOrCharacterBackwards,
+	"delete-char":              eraseSelectionOrCharacterForwards,
+	"backward-kill-word":       eraseAlnumWordBackwards,
+	"kill-word":                eraseAlnumWordForwards,
+	"unix-word-rubout":         eraseWordBackwards,
+	"kill-line":                eraseToEnd,
+	"unix-line-discard":        killLine,
+	"transpose-chars":          transposeCharacters,
+	"capitalize-word":          capitalizeWord,
+	"downcase-word":            lowercaseWord,
+	"upcase-word":              uppercaseWord,
+	"set-mark":                 setMark,
+	"exchange-point-and-mark":  exchangePointAndMark,
+	"copy-region-as-kill":      copyRegion,
+	"kill-region":              killRegion,
+	"yank":                     yank,
+	"yank-last-arg":            insertLastWords,
+	"clear-screen":             clearScreen,
+	"redraw-current-line":      redraw,
+	"edit-and-execute-command": editInExternalEditor,
+	"toggle-reveal-masks":      toggleRevealMasks,
+}
+
+// Action returns the editor's own function called name (as readline names it, e.g. "backward-kill-word"),
+// for binding to other keys, or nil if there's no such function.
+func Action(name string) KeybindingCallback {
+	fn, ok := actions[name]
+	if !ok {
+		return nil
+	}
+	return editorInternal(fn)
+}
@@ -0,0 +1,124 @@
+package line
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	arrowUp   = "\x1b[A"
+	arrowDown = "\x1b[B"
+)
+
+func TestHistoryNavigationRestoresDraft(t *testing.T) {
+	l := newTestEditor(t)
+	l.AddToHistory("foo bar")
+	l.AddToHistory("foo baz")
+	l.historyCursor = uint32(len(l.history))
+
+	// The draft, with the cursor in the middle of it.
+	feed(l, "foo\x1b[D")
+
+	steps := []struct {
+		input string
+		want  string
+	}{
+		{arrowUp, "foo baz"},
+		{arrowUp, "foo bar"},
+		{arrowDown, "foo baz"},
+		{arrowDown, "foo"},
+		// Already back on the draft, there's nothing further down.
+		{arrowDown, "foo"},
+	}
+	for i, step := range steps {
+		feed(l, step.input)
+		if l.Line() != step.want {
+			t.Fatalf("step %d: line is %q, want %q", i+1, l.Line(), step.want)
+		}
+	}
+	if l.cursor != 2 {
+		t.Errorf("cursor is at %d, want it back where it was in the draft (2)", l.cursor)
+	}
+}
+
+func TestCursorRightWordLeavesBufferAlone(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []uint32
+	}{
+		// Bound to moving a character by default.
+		{"Alt-F", "\x1bf", []uint32{1, 2, 3}},
+		{"Ctrl-Right", "\x1b[1;5C", []uint32{3, 7, 7}},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		feed(l, "foo bar")
+		l.cursor = 0
+
+		for _, want := range test.want {
+			feed(l, test.input)
+			if l.cursor != want {
+				t.Errorf("%s: cursor at %d, want %d", test.name, l.cursor, want)
+			}
+			if line := l.Line(); line != "foo bar" || len(l.buffer) != 7 {
+				t.Errorf("%s: buffer is %q", test.name, line)
+			}
+		}
+	}
+}
+
+func TestClearScreenWhileSearching(t *testing.T) {
+	term := newTestTerminal(t, 24, 80)
+	l := newTestEditorOn(t, term)
+	l.AddToHistory("hello world")
+	l.AddToHistory("goodbye")
+	l.historyCursor = uint32(len(l.history))
+
+	// ^G is for looking at the screen once ^L has redrawn it, it's bound as soon as the search starts.
+	var screen string
+	var row, column int
+	l.SetRefreshHandler(func(_ Editor) {
+		if l.searchEditor != nil && screen == "" {
+			l.searchEditor.RegisterKeybinding([]KeyPress{{key: ctrl('G')}}, func(_ []KeyPress, _ Editor) bool {
+				screen = term.String()
+				row, column = term.cursor()
+				return false
+			})
+		}
+	})
+	withInput(t, "hel\x0c\x07\t")
+	feed(l, "\x12")
+
+	if screen != "> hello world\nsearch: hel" {
+		t.Errorf("screen after ^L is %q", screen)
+	}
+	if row != 2 || column != 12 {
+		t.Errorf("cursor after ^L at %d,%d, want 2,12", row, column)
+	}
+	if line := l.Line(); line != "hello world" {
+		t.Errorf("line is %q after the search", line)
+	}
+}
+
+func TestEditInExternalEditor(t *testing.T) {
+	// Somewhere the shell would split the temporary file's name at, if it got the chance.
+	dir := filepath.Join(t.TempDir(), "with space")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMPDIR", dir)
+	t.Setenv("VISUAL", `sed -i -e "s/abc/x y/"`)
+	t.Setenv("EDITOR", "false")
+
+	l := newTestEditor(t)
+	feed(l, "abc")
+	editInExternalEditor(l)
+	if l.Line() != "x y" {
+		t.Errorf("line is %q, want %q", l.Line(), "x y")
+	}
+	if l.cursor != 3 {
+		t.Errorf("cursor is at %d, want it at the end (3)", l.cursor)
+	}
+}
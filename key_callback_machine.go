@@ -4,57 +4,107 @@ func ctrl(k rune) uint32 {
 	return uint32(k & 0x3f)
 }
 
+// controlCharacter returns what terminals send for c pressed with Ctrl, either case of a letter will do.
+func controlCharacter(c rune) uint32 {
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	if c == '?' {
+		return 0x7f
+	}
+	return ctrl(c)
+}
+
+func isControlKey(k uint32) bool {
+	return k < 0x20 || k == 0x7f
+}
+
+func keysEqual(a, b []KeyPress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type keyCallbackMachineImpl struct {
 	keyCallbacks         map[uint32]KeybindingCallback
-	keyAssignments       map[uint32][]key
-	currentMatchingKeys  [][]key
+	keyAssignments       map[uint32][]KeyPress
+	currentMatchingKeys  [][]KeyPress
 	sequenceLength       int
 	shouldProcessThisKey bool
+	disabledKeys         map[uint32]bool
+	nextKeyIndex         uint32
 }
 
-var assignedKeyIndexSerial uint32 = 0
-
 func newKeyCallbackMachine() keyCallbackMachine {
 	return &keyCallbackMachineImpl{
 		keyCallbacks:         make(map[uint32]KeybindingCallback),
-		keyAssignments:       make(map[uint32][]key),
-		currentMatchingKeys:  make([][]key, 0),
+		keyAssignments:       make(map[uint32][]KeyPress),
+		disabledKeys:         make(map[uint32]bool),
+		currentMatchingKeys:  make([][]KeyPress, 0),
 		sequenceLength:       0,
 		shouldProcessThisKey: false,
 	}
 }
 
-func (k *keyCallbackMachineImpl) registerInputCallback(keys []key, callback KeybindingCallback) {
+func (k *keyCallbackMachineImpl) registerInputCallback(keys []KeyPress, callback KeybindingCallback) {
+	if len(keys) == 0 {
+		return
+	}
+
 	assignedIndex := k.findMatchingKeysIndex(keys)
-	if assignedIndex == assignedKeyIndexSerial {
-		assignedKeyIndexSerial++
+	if assignedIndex == k.nextKeyIndex {
+		k.nextKeyIndex++
 	}
 
-	k.keyAssignments[assignedIndex] = keys
+	// Keep our own copy, if the caller reuses the slice the assigned sequence must not change under us.
+	k.keyAssignments[assignedIndex] = append([]KeyPress{}, keys...)
 	k.keyCallbacks[assignedIndex] = callback
+	delete(k.disabledKeys, assignedIndex)
+}
+
+func (k *keyCallbackMachineImpl) disableInputCallback(keys []KeyPress) {
+	if len(keys) == 0 {
+		return
+	}
+
+	assignedIndex := k.findMatchingKeysIndex(keys)
+	if assignedIndex == k.nextKeyIndex {
+		k.nextKeyIndex++
+		k.keyAssignments[assignedIndex] = append([]KeyPress{}, keys...)
+		k.keyCallbacks[assignedIndex] = nil
+	}
+
+	k.disabledKeys[assignedIndex] = true
+}
+
+func (k *keyCallbackMachineImpl) unregisterInputCallback(keys []KeyPress) {
+	assignedIndex := k.findMatchingKeysIndex(keys)
+	if assignedIndex == k.nextKeyIndex {
+		return
+	}
+
+	delete(k.keyAssignments, assignedIndex)
+	delete(k.keyCallbacks, assignedIndex)
+	delete(k.disabledKeys, assignedIndex)
 }
 
-func (k *keyCallbackMachineImpl) findMatchingKeysIndex(keys []key) uint32 {
-	assignedIndex := assignedKeyIndexSerial
+// findMatchingKeysIndex returns the index keys are assigned to, or nextKeyIndex if they aren't assigned yet.
+func (k *keyCallbackMachineImpl) findMatchingKeysIndex(keys []KeyPress) uint32 {
 	for i, assignedKeys := range k.keyAssignments {
-		if len(assignedKeys) == len(keys) {
-			for j, key := range keys {
-				if key != assignedKeys[j] {
-					continue
-				}
-				if j == len(keys)-1 {
-					assignedIndex = i
-					break
-				}
-			}
-		} else {
-			continue
+		if keysEqual(assignedKeys, keys) {
+			return i
 		}
 	}
-	return assignedIndex
+	return k.nextKeyIndex
 }
 
-func (k *keyCallbackMachineImpl) keyPressed(newKey key, editor Editor) {
+func (k *keyCallbackMachineImpl) keyPressed(newKey KeyPress, editor Editor) {
 	if k.sequenceLength == 0 {
 		for i := range k.keyCallbacks {
 			keys := k.keyAssignments[i]
@@ -70,7 +120,7 @@ func (k *keyCallbackMachineImpl) keyPressed(newKey key, editor Editor) {
 	}
 
 	k.sequenceLength++
-	var oldMatchingKeys [][]key
+	var oldMatchingKeys [][]KeyPress
 	oldMatchingKeys = k.currentMatchingKeys
 	k.currentMatchingKeys = nil
 
@@ -87,7 +137,16 @@ func (k *keyCallbackMachineImpl) keyPressed(newKey key, editor Editor) {
 		// Insert any keys that were captured
 		if len(oldMatchingKeys) != 0 {
 			keys := oldMatchingKeys[0]
-			for i := 0; i < k.sequenceLength-1; i++ {
+			if k.disabledKeys[k.findMatchingKeysIndex(keys[:k.sequenceLength-1])] {
+				// The prefix was explicitly disabled, so swallow it.
+				keys = nil
+			}
+			for i := 0; i < len(keys) && i < k.sequenceLength-1; i++ {
+				// Only plain text keys can be put back, modified keys and control
+				// characters were never meant to end up in the buffer.
+				if keys[i].modifiers != 0 || isControlKey(keys[i].key) {
+					continue
+				}
 				editor.InsertChar(rune(keys[i].key))
 			}
 		}
@@ -99,7 +158,14 @@ func (k *keyCallbackMachineImpl) keyPressed(newKey key, editor Editor) {
 	k.shouldProcessThisKey = false
 	for _, matchingKeys := range k.currentMatchingKeys {
 		if len(matchingKeys) == k.sequenceLength {
-			k.shouldProcessThisKey = k.keyCallbacks[k.findMatchingKeysIndex(matchingKeys)](matchingKeys, editor)
+			index := k.findMatchingKeysIndex(matchingKeys)
+			if k.disabledKeys[index] && len(k.currentMatchingKeys) > 1 {
+				// A disabled prefix shouldn't get in the way of longer chords starting with it.
+				continue
+			}
+			if callback := k.keyCallbacks[index]; callback != nil && !k.disabledKeys[index] {
+				k.shouldProcessThisKey = callback(matchingKeys, editor)
+			}
 			k.sequenceLength = 0
 			k.currentMatchingKeys = k.currentMatchingKeys[:0]
 			return
@@ -110,9 +176,12 @@ func (k *keyCallbackMachineImpl) keyPressed(newKey key, editor Editor) {
 func (k *keyCallbackMachineImpl) interrupted(editor Editor) {
 	k.sequenceLength = 0
 	k.currentMatchingKeys = k.currentMatchingKeys[:0]
-	seq := []key{{key: ctrl('C')}}
-	if index := k.findMatchingKeysIndex(seq); index != assignedKeyIndexSerial {
-		k.shouldProcessThisKey = k.keyCallbacks[index](seq, editor)
+	seq := []KeyPress{{key: ctrl('C')}}
+	if index := k.findMatchingKeysIndex(seq); index != k.nextKeyIndex {
+		k.shouldProcessThisKey = false
+		if callback := k.keyCallbacks[index]; callback != nil && !k.disabledKeys[index] {
+			k.shouldProcessThisKey = callback(seq, editor)
+		}
 	} else {
 		k.shouldProcessThisKey = true
 	}
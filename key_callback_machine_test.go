@@ -0,0 +1,58 @@
+package line
+
+import "testing"
+
+func TestIncompleteChord(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []KeyPress
+		input string
+		want  string
+	}{
+		{"ctrl", []KeyPress{Ctrl('X'), Ctrl('E')}, "\x18a", "a"},
+		{"alt", []KeyPress{Alt('x'), {key: 'y'}}, "\x1bxz", "z"},
+		// Plain text typed as the start of a chord is still text.
+		{"text", []KeyPress{{key: 'j'}, {key: 'k'}}, "jx", "jx"},
+	}
+	for _, test := range tests {
+		l := newTestEditor(t)
+		l.RegisterKeybinding(test.keys, func(_ []KeyPress, _ Editor) bool {
+			t.Errorf("%s: the chord was completed", test.name)
+			return false
+		})
+		feed(l, test.input)
+
+		if line := l.Line(); line != test.want {
+			t.Errorf("%s: line is %q, want %q", test.name, line, test.want)
+		}
+	}
+}
+
+func TestChordsSharingTheLastKey(t *testing.T) {
+	machine := newKeyCallbackMachine().(*keyCallbackMachineImpl)
+	var called []string
+	// The same slice for both, as a caller building up chords might do.
+	keys := []KeyPress{{key: ctrl('X')}, {key: ctrl('E')}}
+	machine.registerInputCallback(keys, func(_ []KeyPress, _ Editor) bool {
+		called = append(called, "C-x C-e")
+		return false
+	})
+	keys[0] = KeyPress{key: ctrl('Y')}
+	machine.registerInputCallback(keys, func(_ []KeyPress, _ Editor) bool {
+		called = append(called, "C-y C-e")
+		return false
+	})
+
+	first := machine.findMatchingKeysIndex([]KeyPress{{key: ctrl('X')}, {key: ctrl('E')}})
+	second := machine.findMatchingKeysIndex([]KeyPress{{key: ctrl('Y')}, {key: ctrl('E')}})
+	if first == second || first == machine.nextKeyIndex || second == machine.nextKeyIndex {
+		t.Errorf("C-x C-e and C-y C-e are bound to %d and %d (next is %d)", first, second, machine.nextKeyIndex)
+	}
+
+	for _, k := range []KeyPress{{key: ctrl('Y')}, {key: ctrl('E')}, {key: ctrl('X')}, {key: ctrl('E')}} {
+		machine.keyPressed(k, nil)
+	}
+	if len(called) != 2 || called[0] != "C-y C-e" || called[1] != "C-x C-e" {
+		t.Errorf("called %v", called)
+	}
+}
@@ -0,0 +1,228 @@
+package line
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var namedKeys = map[string]rune{
+	"RET": '\n',
+	"TAB": '\t',
+	"DEL": 0x7f,
+	"ESC": 0x1b,
+	"SPC": ' ',
+}
+
+// ParseKeys parses spec, keys written the way emacs and readline write them, into the keys it stands for.
+// Keys are separated by spaces, each is either
+//
+//   - a single character or one of RET, TAB, DEL, ESC and SPC, optionally preceded by C- for Ctrl
+//     and M- for Alt, e.g. "C-x C-e", "M-." or "C-M-h";
+//   - an escape sequence as an inputrc would write it, starting with a backslash or in double quotes,
+//     where \e, \t, \n, \r, \a, \\, \", \C-x and \M-x are understood, e.g. "\e[A" or "\C-x\C-e".
+//     Escape followed by another character is that character with Alt, just like the terminal sends it.
+func ParseKeys(spec string) ([]KeyPress, error) {
+	var keys []KeyPress
+	for spec = strings.TrimLeft(spec, " \t"); spec != ""; spec = strings.TrimLeft(spec, " \t") {
+		var token string
+		if spec[0] == '"' {
+			end := 1
+			for end < len(spec) && spec[end] != '"' {
+				if spec[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(spec) {
+				return nil, fmt.Errorf("unterminated %q in key sequence", spec)
+			}
+			token, spec = spec[1:end], spec[end+1:]
+			sequence, err := parseEscapedKeys(token)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, sequence...)
+			continue
+		}
+
+		if end := strings.IndexAny(spec, " \t"); end != -1 {
+			token, spec = spec[:end], spec[end:]
+		} else {
+			token, spec = spec, ""
+		}
+		if len(token) > 1 && token[0] == '\\' {
+			sequence, err := parseEscapedKeys(token)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, sequence...)
+			continue
+		}
+
+		k, err := parseKey(token)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("empty key sequence")
+	}
+	return keys, nil
+}
+
+// parseKey parses a single key like "C-x", "M-." or "RET".
+func parseKey(token string) (KeyPress, error) {
+	modifiers := 0
+	name := token
+	for len(name) > 2 && (strings.HasPrefix(name, "C-") || strings.HasPrefix(name, "M-")) {
+		if name[0] == 'C' {
+			modifiers |= ModifierCtrl
+		} else {
+			modifiers |= ModifierAlt
+		}
+		name = name[2:]
+	}
+	if len(name) == 2 && name[0] == '\\' {
+		// Backslashes and quotes are escaped, as KeysString writes them.
+		name = name[1:]
+	}
+
+	c, ok := namedKeys[name]
+	if !ok {
+		if utf8.RuneCountInString(name) != 1 {
+			return KeyPress{}, fmt.Errorf("unknown key %q", token)
+		}
+		c, _ = utf8.DecodeRuneInString(name)
+	}
+	if modifiers&ModifierCtrl != 0 && !hasControlCharacter(c) {
+		return KeyPress{}, fmt.Errorf("%q has no control character", token)
+	}
+	return KeyWithModifiers(c, modifiers), nil
+}
+
+// parseEscapedKeys parses the inputrc-style escape sequence s into the keys the terminal would send for it.
+func parseEscapedKeys(s string) ([]KeyPress, error) {
+	runes := []rune(s)
+	var sequence []rune
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '\\' {
+			sequence = append(sequence, runes[i])
+			continue
+		}
+		if i+1 == len(runes) {
+			return nil, fmt.Errorf("trailing backslash in %q", s)
+		}
+		i++
+		switch runes[i] {
+		case 'e':
+			sequence = append(sequence, 0x1b)
+		case 't':
+			sequence = append(sequence, '\t')
+		case 'n':
+			sequence = append(sequence, '\n')
+		case 'r':
+			sequence = append(sequence, '\r')
+		case 'a':
+			sequence = append(sequence, '\a')
+		case 'C', 'M':
+			// The two can be stacked, as in \C-\M-x.
+			ctrl, meta := false, false
+			for {
+				if i+2 >= len(runes) || runes[i+1] != '-' {
+					return nil, fmt.Errorf("incomplete \\%c- in %q", runes[i], s)
+				}
+				if runes[i] == 'C' {
+					ctrl = true
+				} else {
+					meta = true
+				}
+				i += 2
+				if runes[i] != '\\' || i+2 >= len(runes) || runes[i+1] != 'C' && runes[i+1] != 'M' || runes[i+2] != '-' {
+					break
+				}
+				i++
+			}
+			c := runes[i]
+			if c == '\\' && i+1 < len(runes) {
+				// \C-\\ and the like.
+				i++
+				c = runes[i]
+			}
+			if ctrl {
+				if !hasControlCharacter(c) {
+					return nil, fmt.Errorf("\\C-%c has no control character in %q", c, s)
+				}
+				c = rune(controlCharacter(c))
+			}
+			if meta {
+				sequence = append(sequence, 0x1b)
+			}
+			sequence = append(sequence, c)
+		default:
+			sequence = append(sequence, runes[i])
+		}
+	}
+
+	var keys []KeyPress
+	for i := 0; i < len(sequence); i++ {
+		if sequence[i] == 0x1b && i+1 < len(sequence) {
+			i++
+			keys = append(keys, Alt(sequence[i]))
+			continue
+		}
+		keys = append(keys, Key(sequence[i]))
+	}
+	return keys, nil
+}
+
+// hasControlCharacter returns whether c can be pressed with Ctrl, see controlCharacter.
+func hasControlCharacter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '@' && c <= '_' || c == '?'
+}
+
+// KeysString writes keys the way ParseKeys reads them, e.g. "C-x C-e".
+func KeysString(keys []KeyPress) string {
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, keyString(k))
+	}
+	return strings.Join(names, " ")
+}
+
+func keyString(k KeyPress) string {
+	alt := ""
+	if k.modifiers&ModifierAlt != 0 {
+		alt = "M-"
+	}
+
+	c := rune(k.key)
+	for name, named := range namedKeys {
+		if c == named {
+			return alt + name
+		}
+	}
+	switch {
+	case c < 0x20:
+		return "C-" + alt + string(unicode.ToLower(c+0x40))
+	case c == '\\' || c == '"':
+		return alt + "\\" + string(c)
+	default:
+		return alt + string(c)
+	}
+}
+
+// keysSequence returns what the terminal sends when keys are pressed.
+func keysSequence(keys []KeyPress) []byte {
+	var sequence []rune
+	for _, k := range keys {
+		if k.modifiers&ModifierAlt != 0 {
+			sequence = append(sequence, 0x1b)
+		}
+		sequence = append(sequence, rune(k.key))
+	}
+	return []byte(string(sequence))
+}
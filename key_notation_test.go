@@ -0,0 +1,40 @@
+package line
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []KeyPress
+	}{
+		{"C-x C-e", Chord(Ctrl('x'), Ctrl('e'))},
+		{"M-.", Chord(Alt('.'))},
+		{"C-M-h", Chord(CtrlAlt('h'))},
+		{"RET", Chord(Key('\n'))},
+		{`"\e[A"`, Chord(Alt('['), Key('A'))},
+		{`\C-x\C-e`, Chord(Ctrl('x'), Ctrl('e'))},
+		{`"\C-\\"`, Chord(Ctrl('\\'))},
+		// Modifiers stack either way around.
+		{`"\C-\M-x"`, Chord(CtrlAlt('x'))},
+		{`"\M-\C-x"`, Chord(CtrlAlt('x'))},
+	}
+	for _, test := range tests {
+		keys, err := ParseKeys(test.spec)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("%s: parsed as %q, want %q", test.spec, KeysString(keys), KeysString(test.want))
+		}
+	}
+
+	for _, spec := range []string{"", `"\C-"`, `"\C-\M-"`, `"\C-1"`, "C-1", "foo"} {
+		if keys, err := ParseKeys(spec); err == nil {
+			t.Errorf("%s: parsed as %q, want an error", spec, KeysString(keys))
+		}
+	}
+}
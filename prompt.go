@@ -0,0 +1,98 @@
+package line
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// expandPromptEscapes expands the bash-style prompt escapes in prompt.
+// The supported escapes are:
+//
+//	\u  the current user's name
+//	\h  the hostname up to the first '.'
+//	\H  the full hostname
+//	\w  the current working directory, with $HOME abbreviated to '~'
+//	\W  the last component of the current working directory
+//	\d  the date, as "Mon Jan 02"
+//	\t  the time in 24-hour HH:MM:SS format
+//	\T  the time in 12-hour HH:MM:SS format
+//	\A  the time in 24-hour HH:MM format
+//	\$  '#' for root, '$' otherwise
+//	\n  a newline
+//	\e  an escape character
+//	\a  a bell character
+//	\\  a literal backslash
+//	\[ and \]  ignored, they only mark non-printing sequences in bash
+//
+// Any other escape is left as-is.
+func expandPromptEscapes(prompt string) string {
+	if !strings.ContainsRune(prompt, '\\') {
+		return prompt
+	}
+
+	var builder strings.Builder
+	runes := []rune(prompt)
+	now := time.Now()
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '\\' || i+1 == len(runes) {
+			builder.WriteRune(runes[i])
+			continue
+		}
+
+		i++
+		switch runes[i] {
+		case 'u':
+			if u, err := user.Current(); err == nil {
+				builder.WriteString(u.Username)
+			}
+		case 'h', 'H':
+			host, _ := os.Hostname()
+			if runes[i] == 'h' {
+				if index := strings.IndexByte(host, '.'); index != -1 {
+					host = host[:index]
+				}
+			}
+			builder.WriteString(host)
+		case 'w', 'W':
+			cwd, _ := os.Getwd()
+			if runes[i] == 'W' {
+				cwd = filepath.Base(cwd)
+			} else if home, err := os.UserHomeDir(); err == nil && home != "" && (cwd == home || strings.HasPrefix(cwd, home+"/")) {
+				cwd = "~" + strings.TrimPrefix(cwd, home)
+			}
+			builder.WriteString(cwd)
+		case 'd':
+			builder.WriteString(now.Format("Mon Jan 02"))
+		case 't':
+			builder.WriteString(now.Format("15:04:05"))
+		case 'T':
+			builder.WriteString(now.Format("03:04:05"))
+		case 'A':
+			builder.WriteString(now.Format("15:04"))
+		case '$':
+			if os.Geteuid() == 0 {
+				builder.WriteRune('#')
+			} else {
+				builder.WriteRune('$')
+			}
+		case 'n':
+			builder.WriteRune('\n')
+		case 'e':
+			builder.WriteRune('\x1b')
+		case 'a':
+			builder.WriteRune('\a')
+		case '\\':
+			builder.WriteRune('\\')
+		case '[', ']':
+		default:
+			builder.WriteRune('\\')
+			builder.WriteRune(runes[i])
+		}
+	}
+
+	return builder.String()
+}
@@ -3,12 +3,20 @@ package line
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 func newSuggestionDisplay() suggestionDisplay {
 	return &suggestionDisplayImpl{}
 }
 
+// quickSelectKeys are the keys shown next to each visible suggestion when quick-select is enabled,
+// in the order they are assigned to suggestions on the current page.
+const quickSelectKeys = "123456789abcdefghijklmnopqrstuvwxyz"
+
+// quickSelectLabelWidth is how many columns the "k " label in front of each suggestion takes.
+const quickSelectLabelWidth = 2
+
 type pageRange struct {
 	start uint32
 	end   uint32
@@ -24,23 +32,36 @@ type suggestionDisplayImpl struct {
 	numColumns                        uint32
 	promptLinesAtSuggestionInitiation uint32
 	pages                             []pageRange
+
+	maxLines uint32
+
+	quickSelect      bool
+	quickSelectStart uint32
+	quickSelectCount uint32
 }
 
 func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 	s.isShowingSuggestions = true
 
-	longestSuggestionLength := uint32(0)
-	longestSuggestionByteLength := uint32(0)
-	longestSuggestionByteLengthWithoutTrivia := uint32(0)
+	longestTextWidth := uint32(0)
+	longestTriviaWidth := uint32(0)
 
 	manager.setStartIndex(0)
 	manager.forEachSuggestion(func(completion *Completion, _ uint32) iterationDecision {
-		longestSuggestionLength = max(longestSuggestionLength, uint32(len(completion.textView)+len(completion.displayTriviaView)))
-		longestSuggestionByteLength = max(longestSuggestionByteLength, uint32(len(completion.Text)+len(completion.DisplayTrivia)))
-		longestSuggestionByteLengthWithoutTrivia = max(longestSuggestionByteLengthWithoutTrivia, uint32(len(completion.Text)))
+		longestTextWidth = max(longestTextWidth, completion.textWidth())
+		longestTriviaWidth = max(longestTriviaWidth, completion.triviaWidth())
 		return iterationDecisionContinue
 	})
 
+	// The texts are lined up, and so is the trivia after them.
+	longestSuggestionLength := longestTextWidth
+	if longestTriviaWidth > 0 {
+		longestSuggestionLength += 2 + longestTriviaWidth
+	}
+	if s.quickSelect {
+		longestSuggestionLength += quickSelectLabelWidth
+	}
+
 	numPrinted := uint32(0)
 	linesUsed := uint32(1)
 
@@ -57,11 +78,15 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 	metrics := StringMetrics{LineMetrics: lines}
 	maxLineCount := metrics.LinesWithAddition(&StringMetrics{LineMetrics: []LineMetrics{{Length: 0}}}, s.numColumns)
 
-	if longestSuggestionLength >= s.numColumns-2 {
+	// Written as an addition, as numColumns-2 would wrap around on tiny terminals.
+	if longestSuggestionLength+2 >= s.numColumns {
 		spansEntireLine = true
 		// We should make enough space for the biggest entry in
 		// the suggestion list to fit in the prompt line.
-		start := maxLineCount - s.promptLinesAtSuggestionInitiation
+		start := uint32(0)
+		if maxLineCount > s.promptLinesAtSuggestionInitiation {
+			start = maxLineCount - s.promptLinesAtSuggestionInitiation
+		}
 		for i := start; i < maxLineCount; i++ {
 			os.Stderr.WriteString("\n")
 		}
@@ -85,7 +110,7 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 				numPrinted = 0
 			}
 
-			if linesUsed+s.promptLinesAtSuggestionInitiation >= s.numLines {
+			if s.isOutOfLines(linesUsed) {
 				s.pages = append(s.pages, pageRange{pageStart, index})
 				pageStart = index
 				linesUsed = 1
@@ -105,6 +130,8 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 
 	pageIndex := s.fitToPageBoundary(manager.nextIndex())
 
+	s.quickSelectStart = s.pages[pageIndex].start
+	s.quickSelectCount = 0
 	manager.setStartIndex(s.pages[pageIndex].start)
 	manager.forEachSuggestion(func(suggestion *Completion, index uint32) iterationDecision {
 		nextColumn := numPrinted + uint32(len(suggestion.textView)) + longestSuggestionLength + 2
@@ -118,7 +145,7 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 
 		// Show just enough suggestions to fill up the screen
 		// without moving the prompt out of view
-		if linesUsed+s.promptLinesAtSuggestionInitiation >= s.numLines {
+		if s.isOutOfLines(linesUsed) {
 			return iterationDecisionBreak
 		}
 
@@ -127,15 +154,31 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 			vtApplyStyle(Style{ForegroundColor: MakeXtermColor(XtermColorBlue)}, os.Stderr, true)
 		}
 
+		label := ""
+		if s.quickSelect {
+			label = "  "
+			if labelIndex := index - s.quickSelectStart; labelIndex < uint32(len(quickSelectKeys)) {
+				label = quickSelectKeys[labelIndex:labelIndex+1] + " "
+				s.quickSelectCount++
+			}
+		}
+
 		if spansEntireLine {
 			numPrinted += s.numColumns
+			_, _ = os.Stderr.WriteString(label)
 			_, _ = os.Stderr.WriteString(suggestion.Text)
 			_, _ = os.Stderr.WriteString(suggestion.DisplayTrivia)
 		} else {
-			field := fmt.Sprintf("%-*s  %s", longestSuggestionByteLengthWithoutTrivia, suggestion.Text, suggestion.DisplayTrivia)
-			display := fmt.Sprintf("%-*s", longestSuggestionByteLength+2, field)
-			_, _ = os.Stderr.WriteString(display)
-			numPrinted += longestSuggestionByteLength + 2
+			_, _ = os.Stderr.WriteString(label)
+			_, _ = os.Stderr.WriteString(suggestion.Text)
+			_, _ = os.Stderr.WriteString(strings.Repeat(" ", int(longestTextWidth-suggestion.textWidth())))
+			if longestTriviaWidth > 0 {
+				_, _ = os.Stderr.WriteString("  ")
+				_, _ = os.Stderr.WriteString(suggestion.DisplayTrivia)
+				_, _ = os.Stderr.WriteString(strings.Repeat(" ", int(longestTriviaWidth-suggestion.triviaWidth())))
+			}
+			_, _ = os.Stderr.WriteString("  ")
+			numPrinted += longestSuggestionLength + 2
 		}
 
 		if manager.isCurrentSuggestionComplete() && index == manager.nextIndex() {
@@ -166,8 +209,13 @@ func (s *suggestionDisplayImpl) display(manager suggestionManager) {
 
 		str := fmt.Sprintf("%c page %d of %d %c", leftArrow, pageIndex+1, len(s.pages), rightArrow)
 
-		if uint32(len(str)) > s.numColumns-1 {
-			// This would overflow into the next line, so just don't print an indicator
+		// Written as additions, as subtracting from numColumns would wrap around on tiny terminals.
+		if uint32(len(str))+2 > s.numColumns {
+			// This would overflow into the next line, try one that takes less room.
+			str = fmt.Sprintf("%c%d/%d%c", leftArrow, pageIndex+1, len(s.pages), rightArrow)
+		}
+		if uint32(len(str))+2 > s.numColumns {
+			// Even that won't fit, so just don't print an indicator
 			return
 		}
 
@@ -222,6 +270,41 @@ func (s *suggestionDisplayImpl) originRow() uint32 {
 	return s.originRowValue
 }
 
+func (s *suggestionDisplayImpl) setMaxLines(lines uint32) {
+	s.maxLines = lines
+	s.pages = nil
+}
+
+// isOutOfLines returns whether a row at linesUsed would push the prompt out of view, or go over the configured line limit.
+func (s *suggestionDisplayImpl) isOutOfLines(linesUsed uint32) bool {
+	if s.maxLines != 0 && linesUsed > s.maxLines {
+		return true
+	}
+	return linesUsed+s.promptLinesAtSuggestionInitiation >= s.numLines
+}
+
+func (s *suggestionDisplayImpl) isShowing() bool {
+	return s.isShowingSuggestions
+}
+
+func (s *suggestionDisplayImpl) setQuickSelect(enabled bool) {
+	s.quickSelect = enabled
+}
+
+// quickSelectIndex returns the index of the displayed suggestion labelled with r, if there is one.
+func (s *suggestionDisplayImpl) quickSelectIndex(r rune) (uint32, bool) {
+	if !s.quickSelect || !s.isShowingSuggestions {
+		return 0, false
+	}
+
+	labelIndex := strings.IndexRune(quickSelectKeys, r)
+	if labelIndex < 0 || uint32(labelIndex) >= s.quickSelectCount {
+		return 0, false
+	}
+
+	return s.quickSelectStart + uint32(labelIndex), true
+}
+
 func (s *suggestionDisplayImpl) fitToPageBoundary(selectionIndex uint32) uint32 {
 	index := len(s.pages)
 	for i := len(s.pages) - 1; i >= 0; i-- {
@@ -1,5 +1,7 @@
 package line
 
+import "sort"
+
 func newSuggestionManager() suggestionManager {
 	return &suggestionManagerImpl{}
 }
@@ -13,6 +15,10 @@ type suggestionManagerImpl struct {
 	largestCommonSuggestionPrefixLength uint32
 	lastDisplayedSuggestionIndex        uint32
 	lastSelectedSuggestionIndex         uint32
+	beepOnAmbiguousCompletion           bool
+	confirmSingleSuggestion             bool
+	omitTrailingTrivia                  bool
+	less                                func(a, b Completion) bool
 }
 
 func (s *suggestionManagerImpl) setSuggestions(suggestions []Completion) {
@@ -22,12 +28,22 @@ func (s *suggestionManagerImpl) setSuggestions(suggestions []Completion) {
 		suggestion := &s.suggestions[i]
 		suggestion.textView = []rune(suggestion.Text)
 		suggestion.trailingTriviaView = []rune(suggestion.TrailingTrivia)
+		if s.omitTrailingTrivia {
+			suggestion.trailingTriviaView = nil
+		}
 		suggestion.displayTriviaView = []rune(suggestion.DisplayTrivia)
 	}
 
+	if s.less != nil {
+		sort.SliceStable(s.suggestions, func(i, j int) bool {
+			return s.less(s.suggestions[i], s.suggestions[j])
+		})
+	}
+
+	// The common prefix is that of every suggestion, so which one comes first doesn't matter.
 	commonSuggestionPrefix := uint32(0)
 	if len(s.suggestions) == 1 {
-		s.largestCommonSuggestionPrefixLength = uint32(len(s.suggestions[0].Text))
+		s.largestCommonSuggestionPrefixLength = uint32(len(s.suggestions[0].textView))
 	} else if len(s.suggestions) > 1 {
 		lastValidSuggestionCodePoint := rune(0)
 		for ; ; commonSuggestionPrefix++ {
@@ -49,6 +65,47 @@ func (s *suggestionManagerImpl) setSuggestions(suggestions []Completion) {
 	}
 }
 
+// textWidth returns how many columns the completion's text takes when listed.
+func (c *Completion) textWidth() uint32 {
+	width := uint32(0)
+	for _, r := range c.textView {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// triviaWidth returns how many columns the completion's display trivia takes when listed.
+func (c *Completion) triviaWidth() uint32 {
+	if c.DisplayWidth != 0 {
+		if textWidth := c.textWidth(); c.DisplayWidth > textWidth {
+			return c.DisplayWidth - textWidth
+		}
+		return 0
+	}
+
+	width := uint32(0)
+	for _, r := range c.displayTriviaView {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func (s *suggestionManagerImpl) setBeepOnAmbiguousCompletion(beep bool) {
+	s.beepOnAmbiguousCompletion = beep
+}
+
+func (s *suggestionManagerImpl) setConfirmSingleSuggestion(confirm bool) {
+	s.confirmSingleSuggestion = confirm
+}
+
+func (s *suggestionManagerImpl) setOmitTrailingTrivia(omit bool) {
+	s.omitTrailingTrivia = omit
+}
+
+func (s *suggestionManagerImpl) setSort(less func(a, b Completion) bool) {
+	s.less = less
+}
+
 func (s *suggestionManagerImpl) setCurrentSuggestionInitiationIndex(index uint32) {
 	suggestion := &s.suggestions[s.nextSuggestionIndex]
 	if s.lastShownSuggestionDisplayLength > 0 {
@@ -81,6 +138,12 @@ func (s *suggestionManagerImpl) setStartIndex(u uint32) {
 	s.lastDisplayedSuggestionIndex = u
 }
 
+func (s *suggestionManagerImpl) setNextIndex(u uint32) {
+	if u < uint32(len(s.suggestions)) {
+		s.nextSuggestionIndex = u
+	}
+}
+
 func (s *suggestionManagerImpl) forEachSuggestion(f func(*Completion, uint32) iterationDecision) uint32 {
 	startIndex := uint32(0)
 	for _, suggestion := range s.suggestions {
@@ -105,6 +168,11 @@ func (s *suggestionManagerImpl) attemptCompletion(mode completionMode, initiatio
 		nextSuggestion := &s.suggestions[s.nextSuggestionIndex]
 		if mode == completionModeCompletePrefix && !nextSuggestion.AllowCommitWithoutListing {
 			result.newCompletionMode = completionModeShowSuggestions
+			if s.beepOnAmbiguousCompletion && len(s.suggestions) > 1 {
+				// Like bash, beep on the first ambiguous tab and only list on the second one.
+				result.newCompletionMode = completionModeCompletePrefix
+				result.ringBell = true
+			}
 			result.avoidCommittingToSingleSuggestion = true
 			s.lastShownSuggestionDisplayLength = 0
 			s.lastShownSuggestionWasComplete = false
@@ -114,6 +182,7 @@ func (s *suggestionManagerImpl) attemptCompletion(mode completionMode, initiatio
 
 		canComplete := nextSuggestion.InvariantOffset <= s.largestCommonSuggestionPrefixLength
 		var actualOffset int64
+		removalStart := nextSuggestion.InvariantOffset
 		shownLength := int64(s.lastShownSuggestionDisplayLength)
 		switch mode {
 		case completionModeCompletePrefix:
@@ -124,17 +193,23 @@ func (s *suggestionManagerImpl) attemptCompletion(mode completionMode, initiatio
 				shownLength = int64(s.largestCommonSuggestionPrefixLength + uint32(len(s.lastShownSuggestion.trailingTriviaView)))
 			}
 		default:
+			// Suggestions don't necessarily share offsets, what's in the buffer now
+			// is laid out according to the previously shown one, if there is one rather
+			// than just the common prefix.
+			if len(s.lastShownSuggestion.textView) != 0 {
+				removalStart = s.lastShownSuggestion.InvariantOffset
+			}
 			if s.lastShownSuggestionDisplayLength == 0 {
 				actualOffset = 0
 			} else {
-				actualOffset = int64(0) - int64(s.lastShownSuggestionDisplayLength) + int64(nextSuggestion.InvariantOffset)
+				actualOffset = int64(0) - int64(s.lastShownSuggestionDisplayLength) + int64(removalStart)
 			}
 		}
 
 		suggestion := s.suggest()
 		s.setCurrentSuggestionInitiationIndex(initiationStartIndex)
 
-		result.offsetStartToRemove = nextSuggestion.InvariantOffset
+		result.offsetStartToRemove = removalStart
 		result.offsetEndToRemove = uint32(shownLength)
 		result.newCursorOffset = uint32(actualOffset)
 		result.staticOffsetFromCursor = nextSuggestion.StaticOffset
@@ -145,6 +220,14 @@ func (s *suggestionManagerImpl) attemptCompletion(mode completionMode, initiatio
 				result.insert = append(result.insert, suggestion.textView[suggestion.InvariantOffset:s.largestCommonSuggestionPrefixLength]...)
 				s.lastShownSuggestionDisplayLength = s.largestCommonSuggestionPrefixLength
 				// Do not increment the suggestion index, as the first tab should only be a peek.
+				if len(s.suggestions) == 1 && s.confirmSingleSuggestion {
+					// Only show it for now, another tab commits to it; lastShownSuggestion stays
+					// as it is, the next tab replaces what's shown of it starting at its invariant offset.
+					result.newCompletionMode = completionModeShowSuggestions
+					result.avoidCommittingToSingleSuggestion = true
+					s.lastShownSuggestionWasComplete = false
+					return result
+				}
 				if len(s.suggestions) == 1 {
 					// if there's one suggestion, commit and forget.
 					result.newCompletionMode = completionModeDontComplete
@@ -160,6 +243,11 @@ func (s *suggestionManagerImpl) attemptCompletion(mode completionMode, initiatio
 				s.lastShownSuggestionDisplayLength = 0
 			}
 			result.newCompletionMode = completionModeShowSuggestions
+			if s.beepOnAmbiguousCompletion && len(result.insert) == 0 {
+				// Nothing could be completed, beep and wait for another tab to list the suggestions.
+				result.newCompletionMode = completionModeCompletePrefix
+				result.ringBell = true
+			}
 			s.lastShownSuggestionWasComplete = false
 			s.lastShownSuggestion = Completion{}
 		} else {
@@ -0,0 +1,308 @@
+package line
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// testTerminal is just enough of a VT100 to tell what the editor leaves on screen. Everything written to os.Stderr
+// while it's around goes to it, and is only interpreted when asked for, see update.
+type testTerminal struct {
+	rows, columns int
+	cells         [][]rune
+	// The cursor, 0-based; column == columns means the last column was just written to, and the next
+	// character goes on the next row.
+	row, column           int
+	savedRow, savedColumn int
+
+	// written reads what was written to the terminal, from where the last update left off.
+	written *os.File
+	pending string
+}
+
+func newTestTerminal(t testing.TB, rows, columns int) *testTerminal {
+	t.Helper()
+	output, err := os.CreateTemp(t.TempDir(), "terminal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.Open(output.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = output
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		output.Close()
+		written.Close()
+	})
+
+	term := &testTerminal{rows: rows, columns: columns, written: written}
+	term.cells = make([][]rune, rows)
+	for i := range term.cells {
+		term.cells[i] = term.blankRow()
+	}
+	return term
+}
+
+// resize changes the width of the terminal without rewrapping anything, like xterm does; rows are cut short
+// or padded with blanks.
+func (t *testTerminal) resize(columns int) {
+	t.update()
+	for i, row := range t.cells {
+		if columns < len(row) {
+			t.cells[i] = row[:columns]
+		} else {
+			t.cells[i] = append(row, []rune(strings.Repeat(" ", columns-len(row)))...)
+		}
+	}
+	t.columns = columns
+	t.clampColumn()
+}
+
+func (t *testTerminal) blankRow() []rune {
+	return []rune(strings.Repeat(" ", t.columns))
+}
+
+// update interprets what was written since the last update, and returns it.
+func (t *testTerminal) update() string {
+	written, _ := io.ReadAll(t.written)
+	t.pending += string(written)
+
+	// Leave a sequence that's been cut short for the next update.
+	input := t.pending
+	t.pending = ""
+	for i := 0; i < len(input); {
+		n := t.interpret(input[i:])
+		if n == 0 {
+			t.pending = input[i:]
+			break
+		}
+		i += n
+	}
+	return string(written)
+}
+
+// interpret interprets the character or sequence input starts with, and returns how many bytes of it that took,
+// 0 if it needs more.
+func (t *testTerminal) interpret(input string) int {
+	if !utf8.FullRuneInString(input) {
+		return 0
+	}
+	c, size := utf8.DecodeRuneInString(input)
+	switch c {
+	case '\r':
+		t.column = 0
+	case '\n':
+		// Output processing turns newlines into CRLFs.
+		t.column = 0
+		t.lineFeed()
+	case '\b':
+		t.clampColumn()
+		if t.column > 0 {
+			t.column--
+		}
+	case '\t':
+		t.clampColumn()
+		t.column = (t.column/8 + 1) * 8
+		if t.column >= t.columns {
+			t.column = t.columns - 1
+		}
+	case '\x1b':
+		return t.interpretEscape(input)
+	default:
+		if c < 0x20 || c == 0x7f {
+			break
+		}
+		t.put(c)
+	}
+	return size
+}
+
+func (t *testTerminal) interpretEscape(input string) int {
+	if len(input) < 2 {
+		return 0
+	}
+	switch input[1] {
+	case '[':
+		end := 2
+		for end < len(input) && (input[end] < 0x40 || input[end] > 0x7e) {
+			end++
+		}
+		if end == len(input) {
+			return 0
+		}
+		t.interpretCSI(input[2:end], input[end])
+		return end + 1
+	case ']':
+		// OSC, up to BEL or ST.
+		for end := 2; end < len(input); end++ {
+			if input[end] == '\a' {
+				return end + 1
+			}
+			if input[end] == '\x1b' && end+1 < len(input) && input[end+1] == '\\' {
+				return end + 2
+			}
+		}
+		return 0
+	case '7':
+		t.savedRow, t.savedColumn = t.row, t.column
+	case '8':
+		t.row, t.column = t.savedRow, t.savedColumn
+	}
+	return 2
+}
+
+func (t *testTerminal) interpretCSI(parameters string, final byte) {
+	if strings.HasPrefix(parameters, "?") {
+		// Private modes don't change what's on screen.
+		return
+	}
+	var values []int
+	for _, p := range strings.Split(parameters, ";") {
+		value, _ := strconv.Atoi(p)
+		values = append(values, value)
+	}
+	parameter := func(i, fallback int) int {
+		if i >= len(values) || values[i] == 0 {
+			return fallback
+		}
+		return values[i]
+	}
+
+	t.clampColumn()
+	switch final {
+	case 'H', 'f':
+		t.row = minInt(parameter(0, 1), t.rows) - 1
+		t.column = minInt(parameter(1, 1), t.columns) - 1
+	case 'A':
+		t.row = maxInt(t.row-parameter(0, 1), 0)
+	case 'B':
+		t.row = minInt(t.row+parameter(0, 1), t.rows-1)
+	case 'C':
+		t.column = minInt(t.column+parameter(0, 1), t.columns-1)
+	case 'D':
+		t.column = maxInt(t.column-parameter(0, 1), 0)
+	case 'G':
+		t.column = minInt(parameter(0, 1), t.columns) - 1
+	case 'J':
+		switch parameter(0, 0) {
+		case 0:
+			t.clear(t.row, t.column, t.rows-1, t.columns)
+		case 1:
+			t.clear(0, 0, t.row, t.column+1)
+		case 2:
+			t.clear(0, 0, t.rows-1, t.columns)
+		}
+	case 'K':
+		switch parameter(0, 0) {
+		case 0:
+			t.clear(t.row, t.column, t.row, t.columns)
+		case 1:
+			t.clear(t.row, 0, t.row, t.column+1)
+		case 2:
+			t.clear(t.row, 0, t.row, t.columns)
+		}
+	case 'S':
+		for i := parameter(0, 1); i > 0; i-- {
+			t.scroll()
+		}
+	case 's':
+		t.savedRow, t.savedColumn = t.row, t.column
+	case 'u':
+		t.row, t.column = t.savedRow, t.savedColumn
+	}
+}
+
+// put writes c at the cursor, wide characters take up the cell after theirs as well.
+func (t *testTerminal) put(c rune) {
+	width := int(runeWidth(c))
+	if t.column+width > t.columns {
+		t.column = 0
+		t.lineFeed()
+	}
+	t.cells[t.row][t.column] = c
+	for i := 1; i < width; i++ {
+		t.cells[t.row][t.column+i] = 0
+	}
+	t.column += width
+}
+
+// clampColumn moves a cursor that's past the last column back onto it, as everything but writing does.
+func (t *testTerminal) clampColumn() {
+	if t.column >= t.columns {
+		t.column = t.columns - 1
+	}
+}
+
+func (t *testTerminal) lineFeed() {
+	if t.row == t.rows-1 {
+		t.scroll()
+		return
+	}
+	t.row++
+}
+
+func (t *testTerminal) scroll() {
+	t.cells = append(t.cells[1:], t.blankRow())
+}
+
+// clear blanks everything from (fromRow, fromColumn) up to (but not including) (toRow, toColumn).
+func (t *testTerminal) clear(fromRow, fromColumn, toRow, toColumn int) {
+	for row := fromRow; row <= toRow; row++ {
+		start, end := 0, t.columns
+		if row == fromRow {
+			start = fromColumn
+		}
+		if row == toRow {
+			end = toColumn
+		}
+		for column := start; column < end && column < t.columns; column++ {
+			t.cells[row][column] = ' '
+		}
+	}
+}
+
+// line returns what's on row (1-based), without trailing blanks.
+func (t *testTerminal) line(row int) string {
+	t.update()
+	return strings.TrimRight(strings.ReplaceAll(string(t.cells[row-1]), "\x00", ""), " ")
+}
+
+// String returns what's on screen, a line per row, leaving out the blank rows at the bottom.
+func (t *testTerminal) String() string {
+	t.update()
+	lines := make([]string, t.rows)
+	for i := range lines {
+		lines[i] = t.line(i + 1)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// cursor returns where the cursor is (1-based).
+func (t *testTerminal) cursor() (row, column int) {
+	t.update()
+	return t.row + 1, minInt(t.column, t.columns-1) + 1
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
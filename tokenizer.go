@@ -0,0 +1,67 @@
+package line
+
+import "strings"
+
+// Token is one of the tokens a Tokenizer splits a line into. Start and End are its bounds in the line,
+// in code points, and Text is what it stands for, e.g. without the quotes it was written with.
+type Token struct {
+	Text  string
+	Start uint32
+	End   uint32
+}
+
+// Tokenizer splits line into tokens, and returns the index of the one the cursor is in (or right after),
+// or -1 if the cursor isn't in one.
+type Tokenizer func(line string, cursor uint32) (tokens []Token, current int)
+
+// ShellTokenizer returns a Tokenizer that splits lines the way shells do: at whitespace and any of delimiters
+// (e.g. ":" for PATH-like values), unless within single or double quotes or escaped with a backslash.
+func ShellTokenizer(delimiters string) Tokenizer {
+	return func(line string, cursor uint32) ([]Token, int) {
+		var tokens []Token
+		current := -1
+
+		runes := []rune(line)
+		var text []rune
+		var start uint32
+		inToken := false
+		quote := rune(0)
+		endToken := func(end uint32) {
+			if !inToken {
+				return
+			}
+			if start <= cursor && cursor <= end {
+				current = len(tokens)
+			}
+			tokens = append(tokens, Token{Text: string(text), Start: start, End: end})
+			text = text[:0]
+			inToken = false
+		}
+
+		for i := 0; i < len(runes); i++ {
+			c := runes[i]
+			if quote == 0 && (isSpace(c) || strings.ContainsRune(delimiters, c)) {
+				endToken(uint32(i))
+				continue
+			}
+			if !inToken {
+				inToken = true
+				start = uint32(i)
+			}
+			switch {
+			case c == '\\' && quote != '\'' && i+1 < len(runes):
+				i++
+				text = append(text, runes[i])
+			case c == quote:
+				quote = 0
+			case quote == 0 && (c == '\'' || c == '"'):
+				quote = c
+			default:
+				text = append(text, c)
+			}
+		}
+		endToken(uint32(len(runes)))
+
+		return tokens, current
+	}
+}